@@ -1,22 +1,124 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/cbuto/contrast-agent-injector/pkg/fetch"
+	"github.com/cbuto/contrast-agent-injector/pkg/mergeconfig"
 	"github.com/cbuto/contrast-agent-injector/pkg/webhooks"
 	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 )
 
+// policyStatusInterval is how often the Pods injected by AgentInjectionPolicies are added to their status
+const policyStatusInterval = 30 * time.Second
+
 // WebhookServerParams is a struct containing the configuration for the webhook HTTP server
 type WebhookServerParams struct {
-	Port       int
-	CertFile   string
-	KeyFile    string
-	SecretName string
+	Port         int
+	CertFile     string
+	KeyFile      string
+	SecretName   string
+	AgentsConfig string
+	DeliveryMode string
+	VersionTTL   time.Duration
+	// InjectorImage is the image init containers run fetch-agent with
+	InjectorImage string
+	FailurePolicy string
+	// ArtifactCache enables the artifact cache when set
+	ArtifactCache ArtifactCacheParams
+	InitContainer InitContainerParams
+	// PodSecurity checks that mutated Pods pass the Pod Security Standard enforced in their namespace
+	PodSecurity bool
+	// ImagePullSecrets is a comma separated list of secrets added to mutated Pods
+	ImagePullSecrets string
+	// CopyImagePullSecrets copies the image pull secrets from Namespace into the namespace of mutated Pods
+	CopyImagePullSecrets bool
+	// Namespace is the namespace the injector runs in
+	Namespace string
+	// AllowConfigAPIOverrides allows the config-yaml annotation to override the api settings of the secret
+	AllowConfigAPIOverrides bool
+	// CheckConfigMaps warns when the ConfigMaps referenced by the config-from annotation don't exist
+	CheckConfigMaps bool
+	// NamespaceDefaults uses the injector annotations of namespaces as the defaults of their Pods
+	NamespaceDefaults bool
+	// InjectionPolicies injects the Pods selected by AgentInjectionPolicies
+	InjectionPolicies bool
+}
+
+// InitContainerParams is a struct containing the default resources and user of the injected init containers
+type InitContainerParams struct {
+	CPURequest    string
+	CPULimit      string
+	MemoryRequest string
+	MemoryLimit   string
+	User          int64
+}
+
+// resources parses the init container requests and limits, empty quantities are left unset
+func (params InitContainerParams) resources() (*corev1.ResourceRequirements, error) {
+	resources := &corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{},
+		Limits:   corev1.ResourceList{},
+	}
+	quantities := []struct {
+		flag  string
+		value string
+		list  corev1.ResourceList
+		name  corev1.ResourceName
+	}{
+		{"initContainerCPURequest", params.CPURequest, resources.Requests, corev1.ResourceCPU},
+		{"initContainerCPULimit", params.CPULimit, resources.Limits, corev1.ResourceCPU},
+		{"initContainerMemoryRequest", params.MemoryRequest, resources.Requests, corev1.ResourceMemory},
+		{"initContainerMemoryLimit", params.MemoryLimit, resources.Limits, corev1.ResourceMemory},
+	}
+	for _, quantity := range quantities {
+		if len(quantity.value) == 0 {
+			continue
+		}
+		parsed, err := resource.ParseQuantity(quantity.value)
+		if err != nil {
+			return nil, fmt.Errorf("--%v is not a valid quantity: %v", quantity.flag, err)
+		}
+		quantity.list[quantity.name] = parsed
+	}
+	return resources, nil
+}
+
+// ArtifactCacheParams is a struct containing the configuration for the artifact cache HTTP server
+type ArtifactCacheParams struct {
+	Port      int
+	Dir       string
+	SeedDir   string
+	URL       string
+	AirGapped bool
+}
+
+// splitNames splits a comma separated list, ignoring empty names
+func splitNames(names string) []string {
+	var result []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); len(name) != 0 {
+			result = append(result, name)
+		}
+	}
+	return result
 }
 
 func livenessHandler(response http.ResponseWriter, request *http.Request) {
@@ -27,16 +129,67 @@ func livenessHandler(response http.ResponseWriter, request *http.Request) {
 }
 
 func main() {
+	// The injector image is also used by the init containers to download the agent and merge the config
+	if len(os.Args) > 1 && os.Args[1] == "fetch-agent" {
+		os.Exit(fetch.Run(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "merge-config" {
+		os.Exit(mergeconfig.Run(os.Args[2:]))
+	}
+
 	var params WebhookServerParams
 	flag.IntVar(&params.Port, "port", 8443, "Webhook server port.")
 	flag.StringVar(&params.CertFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate")
 	flag.StringVar(&params.KeyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key for the certificate")
 	flag.StringVar(&params.SecretName, "secretName", "", "Kubernetes secret containing the contrast_security.yaml file")
+	flag.StringVar(&params.AgentsConfig, "agentsConfig", "", "File containing agent definitions to add to or replace the default agents")
+	flag.StringVar(&params.DeliveryMode, "deliveryMode", webhooks.DeliveryDownload, "How the agent is staged into pods: download it in the init container, or copy it from an agent image")
+	flag.DurationVar(&params.VersionTTL, "versionCacheTTL", 10*time.Minute, "How long the agent versions latest and version ranges are resolved against are cached")
+	flag.StringVar(&params.InjectorImage, "injectorImage", webhooks.DefaultInjectorImage, "Image of the injector, used by init containers downloading the agent with the fetch-agent command")
+	flag.StringVar(&params.FailurePolicy, "failurePolicy", webhooks.FailurePolicyClosed, "What happens when the init container can't stage the agent: closed stops the Pod from starting, open starts the application without the agent")
+	flag.StringVar(&params.ArtifactCache.Dir, "artifactCacheDir", "", "Directory agent artifacts are cached in, enables the artifact cache")
+	flag.StringVar(&params.ArtifactCache.SeedDir, "artifactCacheSeedDir", "", "Directory containing <language>/<version> agent artifacts copied into the artifact cache on startup")
+	flag.StringVar(&params.ArtifactCache.URL, "artifactCacheURL", "", "URL pods download cached agents from, e.g. http://contrast-agent-injector.<namespace>.svc:8080")
+	flag.IntVar(&params.ArtifactCache.Port, "artifactCachePort", 8080, "Artifact cache server port.")
+	flag.BoolVar(&params.ArtifactCache.AirGapped, "airGapped", false, "Only serve the agents in the artifact cache, never download them from upstream")
+	flag.BoolVar(&params.PodSecurity, "podSecurity", false, "Skip injection when the mutated Pod would violate the Pod Security Standard enforced in its namespace, requires list and watch access to namespaces")
+	flag.StringVar(&params.ImagePullSecrets, "imagePullSecrets", "", "Comma separated image pull secrets added to mutated Pods, e.g. for private agent or injector images")
+	flag.BoolVar(&params.CopyImagePullSecrets, "copyImagePullSecrets", false, "Copy the image pull secrets from the injector's namespace into the namespace of mutated Pods, requires access to secrets")
+	flag.BoolVar(&params.AllowConfigAPIOverrides, "allowConfigAPIOverrides", false, "Allow the contrast-agent-injector/config-yaml annotation to override the api settings of the contrast_security.yaml secret")
+	flag.BoolVar(&params.CheckConfigMaps, "checkConfigMaps", false, "Warn when the ConfigMaps referenced by the contrast-agent-injector/config-from annotation don't exist, requires list and watch access to ConfigMaps and caches every ConfigMap of the cluster")
+	flag.BoolVar(&params.NamespaceDefaults, "namespaceDefaults", false, "Use the contrast-agent-injector annotations of namespaces as the defaults of their Pods, requires list and watch access to namespaces")
+	flag.BoolVar(&params.InjectionPolicies, "injectionPolicies", false, "Inject the Pods selected by AgentInjectionPolicies and report the Pods injected in their status, requires the AgentInjectionPolicy CRD, access to AgentInjectionPolicies and list and watch access to namespaces")
+	flag.StringVar(&params.Namespace, "namespace", os.Getenv("POD_NAMESPACE"), "Namespace the injector runs in, the image pull secrets are copied from")
+	defaults := webhooks.DefaultInitContainerResources()
+	flag.StringVar(&params.InitContainer.CPURequest, "initContainerCPURequest", defaults.Requests.Cpu().String(), "CPU request of the init containers, empty to leave it unset")
+	flag.StringVar(&params.InitContainer.CPULimit, "initContainerCPULimit", defaults.Limits.Cpu().String(), "CPU limit of the init containers, empty to leave it unset")
+	flag.StringVar(&params.InitContainer.MemoryRequest, "initContainerMemoryRequest", defaults.Requests.Memory().String(), "Memory request of the init containers, empty to leave it unset")
+	flag.StringVar(&params.InitContainer.MemoryLimit, "initContainerMemoryLimit", defaults.Limits.Memory().String(), "Memory limit of the init containers, empty to leave it unset")
+	flag.Int64Var(&params.InitContainer.User, "initContainerUser", webhooks.DefaultInitContainerUser, "User and group the init containers run as when the Pod doesn't set a non root user")
 	flag.Parse()
 
 	if len(params.SecretName) == 0 {
 		log.Fatal("--secretName required")
 	}
+	if params.DeliveryMode != webhooks.DeliveryDownload && params.DeliveryMode != webhooks.DeliveryImage {
+		log.Fatalf("--deliveryMode must be %v or %v", webhooks.DeliveryDownload, webhooks.DeliveryImage)
+	}
+	if params.FailurePolicy != webhooks.FailurePolicyClosed && params.FailurePolicy != webhooks.FailurePolicyOpen {
+		log.Fatalf("--failurePolicy must be %v or %v", webhooks.FailurePolicyClosed, webhooks.FailurePolicyOpen)
+	}
+	if params.InitContainer.User <= 0 {
+		log.Fatal("--initContainerUser must be a non root user")
+	}
+	initContainerResources, err := params.InitContainer.resources()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if params.CopyImagePullSecrets && len(params.Namespace) == 0 {
+		log.Fatal("--namespace required when --copyImagePullSecrets is set")
+	}
+	if len(params.ArtifactCache.Dir) != 0 && len(params.ArtifactCache.URL) == 0 {
+		log.Fatal("--artifactCacheURL required when --artifactCacheDir is set")
+	}
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(os.Stdout)
 	log.SetLevel(log.InfoLevel)
@@ -46,8 +199,79 @@ func main() {
 		log.Fatal("Failed to load key pair: ", err)
 	}
 
+	agents, err := webhooks.LoadAgentRegistry(params.AgentsConfig)
+	if err != nil {
+		log.Fatal("Failed to load agent definitions: ", err)
+	}
+
+	if len(params.ArtifactCache.Dir) != 0 {
+		if err := webhooks.ValidateArtifactCache(agents, params.ArtifactCache.AirGapped); err != nil {
+			log.Fatal("Invalid artifact cache: ", err)
+		}
+	}
+
+	verifier := webhooks.NewArtifactVerifier(&http.Client{Timeout: 20 * time.Second})
 	mutateConfig := &webhooks.MutateConfig{
-		SecretName: params.SecretName,
+		SecretName:    params.SecretName,
+		Agents:        agents,
+		DeliveryMode:  params.DeliveryMode,
+		Verifier:      verifier,
+		Resolver:      webhooks.NewVersionResolver(&http.Client{Timeout: 10 * time.Second}, params.VersionTTL),
+		InjectorImage: params.InjectorImage,
+		FailurePolicy: params.FailurePolicy,
+
+		InitContainerResources: initContainerResources,
+		InitContainerUser:      params.InitContainer.User,
+		ImagePullSecrets:       splitNames(params.ImagePullSecrets),
+
+		AllowConfigAPIOverrides: params.AllowConfigAPIOverrides,
+	}
+
+	var client kubernetes.Interface
+	watchNamespaces := params.PodSecurity || params.NamespaceDefaults || params.InjectionPolicies
+	if watchNamespaces || params.CopyImagePullSecrets || params.CheckConfigMaps {
+		client, err = kubernetesClient()
+		if err != nil {
+			log.Fatal("Failed to create Kubernetes client: ", err)
+		}
+	}
+
+	if watchNamespaces || params.CheckConfigMaps {
+		namespaces, configMaps, err := startInformers(client, watchNamespaces, params.CheckConfigMaps)
+		if err != nil {
+			log.Fatal("Failed to watch the cluster: ", err)
+		}
+		if params.PodSecurity {
+			mutateConfig.Namespaces = namespaces
+		}
+		if params.NamespaceDefaults {
+			mutateConfig.NamespaceDefaults = namespaces
+		}
+		if configMaps != nil {
+			mutateConfig.ConfigMaps = configMaps
+		}
+		if params.InjectionPolicies {
+			dynamicClient, err := dynamicClient()
+			if err != nil {
+				log.Fatal("Failed to create Kubernetes client: ", err)
+			}
+			policies, err := startPolicyInformer(dynamicClient)
+			if err != nil {
+				log.Fatal("Failed to watch the AgentInjectionPolicies: ", err)
+			}
+			mutateConfig.InjectionPolicies = webhooks.NewInjectionPolicies(webhooks.NewDynamicPolicyLister(policies), namespaces)
+			mutateConfig.InjectionPolicyStatus = webhooks.NewInjectionPolicyStatus(dynamicClient)
+			go mutateConfig.InjectionPolicyStatus.Run(context.Background(), policyStatusInterval)
+		}
+	}
+
+	if params.CopyImagePullSecrets {
+		mutateConfig.PullSecretCopier = webhooks.NewPullSecretCopier(client, params.Namespace)
+	}
+
+	if len(params.ArtifactCache.Dir) != 0 {
+		mutateConfig.ArtifactCacheURL = params.ArtifactCache.URL
+		go startArtifactCache(params.ArtifactCache, agents, verifier)
 	}
 
 	server := &http.Server{
@@ -65,3 +289,93 @@ func main() {
 		log.Fatal("Failed to start webhook server: ", err)
 	}
 }
+
+// kubernetesClient returns a client for the cluster the injector runs in
+func kubernetesClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// dynamicClient returns a client for the custom resources of the cluster the injector runs in
+func dynamicClient() (dynamic.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+// startInformers watches the namespaces and the ConfigMaps of the cluster the injector runs in, as enabled, and
+// returns listers backed by the informer caches once they have synced
+func startInformers(client kubernetes.Interface, watchNamespaces, watchConfigMaps bool) (corelisters.NamespaceLister, corelisters.ConfigMapLister, error) {
+	factory := informers.NewSharedInformerFactory(client, 10*time.Minute)
+	var namespaces corelisters.NamespaceLister
+	var configMaps corelisters.ConfigMapLister
+	var synced []cache.InformerSynced
+	if watchNamespaces {
+		informer := factory.Core().V1().Namespaces()
+		namespaces = informer.Lister()
+		synced = append(synced, informer.Informer().HasSynced)
+	}
+	if watchConfigMaps {
+		informer := factory.Core().V1().ConfigMaps()
+		configMaps = informer.Lister()
+		synced = append(synced, informer.Informer().HasSynced)
+	}
+	factory.Start(wait.NeverStop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return nil, nil, fmt.Errorf("informer caches didn't sync")
+	}
+	return namespaces, configMaps, nil
+}
+
+// startPolicyInformer watches the AgentInjectionPolicies of the cluster and returns a lister backed by the informer
+// cache once it has synced
+func startPolicyInformer(client dynamic.Interface) (cache.GenericLister, error) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 10*time.Minute)
+	informer := factory.ForResource(webhooks.AgentInjectionPolicyResource)
+	lister := informer.Lister()
+	factory.Start(wait.NeverStop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		return nil, fmt.Errorf("informer cache didn't sync, is the AgentInjectionPolicy CRD installed?")
+	}
+	return lister, nil
+}
+
+// startArtifactCache serves the cached agents over plain HTTP, the init containers verify the agents they download
+// against the checksums passed to them by the webhook
+func startArtifactCache(params ArtifactCacheParams, agents webhooks.AgentRegistry, verifier *webhooks.ArtifactVerifier) {
+	cache := webhooks.NewArtifactCache(params.Dir, agents, verifier, &http.Client{Timeout: 5 * time.Minute}, params.AirGapped)
+	if len(params.SeedDir) != 0 {
+		if err := cache.Seed(params.SeedDir); err != nil {
+			log.Fatal("Failed to seed artifact cache: ", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live", livenessHandler)
+	mux.Handle("/agents/", cache)
+	log.Info("Starting artifact cache server on port: ", params.Port)
+
+	// Writes can include downloading the agent from upstream before it is served
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%v", params.Port),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      10 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal("Failed to start artifact cache server: ", err)
+	}
+}
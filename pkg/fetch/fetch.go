@@ -0,0 +1,355 @@
+// Package fetch implements the fetch-agent command, which the init containers injected by the webhook run to
+// download the agent into the agent volume.
+package fetch
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes of the fetch-agent command
+const (
+	ExitOK = iota
+	ExitUsage
+	ExitDownloadFailed
+	ExitVerificationFailed
+	ExitWriteFailed
+)
+
+const (
+	// PolicyFail fails when the agent doesn't match its checksum
+	PolicyFail = `fail`
+	// PolicyUninstrumented removes an agent that doesn't match its checksum and exits successfully
+	PolicyUninstrumented = `uninstrumented`
+)
+
+const (
+	// FailurePolicyClosed exits with an error when the agent can't be staged, so the Pod doesn't start
+	FailurePolicyClosed = `closed`
+	// FailurePolicyOpen always exits successfully, the application starts without the agent if it can't be staged
+	FailurePolicyOpen = `open`
+)
+
+// Options configures how the agent is downloaded
+type Options struct {
+	URL string
+	// Output is the file the agent is written to
+	Output string
+	// Extract is a directory the agent is unzipped into, the downloaded archive is removed
+	Extract  string
+	SHA256   string
+	Size     int64
+	Username string
+	Password string
+	Policy   string
+	// FailurePolicy is open or closed
+	FailurePolicy string
+	// Placeholder is written to the output when the application starts without the agent, so the flags loading the
+	// agent don't stop the application from starting
+	Placeholder string
+	Retries     int
+	Timeout     time.Duration
+	Backoff     time.Duration
+	Client      *http.Client
+}
+
+// verificationError is returned when the downloaded agent doesn't match the expected size or checksum
+type verificationError struct {
+	err error
+}
+
+func (err verificationError) Error() string {
+	return err.err.Error()
+}
+
+// retryableError is returned for failed downloads that may succeed when retried
+type retryableError struct {
+	err error
+}
+
+func (err retryableError) Error() string {
+	return err.err.Error()
+}
+
+// httpError is returned when the server responds with an unexpected status
+type httpError struct {
+	status string
+}
+
+func (err httpError) Error() string {
+	return fmt.Sprintf("unexpected status %v", err.status)
+}
+
+// Run parses the fetch-agent arguments, downloads the agent and returns the exit code. The checksum, verification
+// policy and credentials default to the env vars the webhook sets on the init container.
+func Run(args []string) int {
+	log.SetFormatter(&log.JSONFormatter{})
+	log.SetOutput(os.Stdout)
+	log.SetLevel(log.InfoLevel)
+
+	var options Options
+	flags := flag.NewFlagSet("fetch-agent", flag.ContinueOnError)
+	flags.StringVar(&options.FailurePolicy, "failure-policy", os.Getenv("CONTRAST_FAILURE_POLICY"), "What happens when the agent can't be staged, closed fails and open starts the application without the agent")
+	flags.StringVar(&options.Placeholder, "placeholder", "", "Placeholder written to the output when the application starts without the agent, javaagent")
+	flags.StringVar(&options.URL, "url", "", "URL the agent is downloaded from")
+	flags.StringVar(&options.Output, "output", "", "File the agent is written to")
+	flags.StringVar(&options.Extract, "extract", "", "Directory the downloaded zip archive is extracted into")
+	flags.StringVar(&options.SHA256, "sha256", os.Getenv("CONTRAST_AGENT_SHA256"), "Expected SHA-256 of the agent")
+	flags.Int64Var(&options.Size, "size", 0, "Expected size of the agent in bytes")
+	flags.StringVar(&options.Policy, "policy", os.Getenv("CONTRAST_VERIFICATION_POLICY"), "What happens when the agent doesn't match its checksum, fail or uninstrumented")
+	flags.IntVar(&options.Retries, "retries", 5, "Number of times a failed download is retried")
+	flags.DurationVar(&options.Timeout, "timeout", 2*time.Minute, "Timeout of each download attempt")
+	flags.DurationVar(&options.Backoff, "backoff", time.Second, "Delay before the first retry, doubled for every retry")
+	if err := flags.Parse(args); err != nil {
+		return options.failed(ExitUsage, err)
+	}
+	options.Username = os.Getenv("CONTRAST_MIRROR_USERNAME")
+	options.Password = os.Getenv("CONTRAST_MIRROR_PASSWORD")
+
+	if err := options.validate(); err != nil {
+		return options.failed(ExitUsage, err)
+	}
+
+	log.WithField("url", options.URL).Info("Downloading Contrast agent")
+	err := Fetch(context.Background(), options)
+	var verificationErr verificationError
+	var retryableErr retryableError
+	var statusErr httpError
+	switch {
+	case err == nil:
+		log.WithField("output", options.Output).Info("Finished downloading Contrast agent")
+		return ExitOK
+	case errors.As(err, &verificationErr) && options.Policy == PolicyUninstrumented:
+		log.WithError(err).Warn("Contrast agent failed verification")
+		return options.uninstrumented()
+	case errors.As(err, &verificationErr):
+		return options.failed(ExitVerificationFailed, fmt.Errorf("Contrast agent failed verification: %v", err))
+	case errors.As(err, &retryableErr), errors.As(err, &statusErr):
+		return options.failed(ExitDownloadFailed, fmt.Errorf("could not download Contrast agent: %v", err))
+	default:
+		return options.failed(ExitWriteFailed, fmt.Errorf("could not write Contrast agent: %v", err))
+	}
+}
+
+// failed logs err and returns exitCode, or starts the application without the agent with the open failure policy
+func (options Options) failed(exitCode int, err error) int {
+	if options.FailurePolicy != FailurePolicyOpen {
+		log.WithField("exitCode", exitCode).Error(err)
+		return exitCode
+	}
+	log.WithField("exitCode", exitCode).Warn(err)
+	return options.uninstrumented()
+}
+
+// uninstrumented replaces the agent with the placeholder, so the application starts without the agent
+func (options Options) uninstrumented() int {
+	log.Warn("Starting the application without the Contrast agent")
+	if len(options.Output) == 0 {
+		return ExitOK
+	}
+	if err := writePlaceholder(options.Placeholder, options.Output); err != nil {
+		log.WithError(err).Error("Could not write the agent placeholder")
+		if options.FailurePolicy == FailurePolicyOpen {
+			return ExitOK
+		}
+		return ExitWriteFailed
+	}
+	return ExitOK
+}
+
+func (options Options) validate() error {
+	if len(options.URL) == 0 || len(options.Output) == 0 {
+		return fmt.Errorf("--url and --output are required")
+	}
+	switch options.Policy {
+	case "", PolicyFail, PolicyUninstrumented:
+	default:
+		return fmt.Errorf("--policy must be %v or %v", PolicyFail, PolicyUninstrumented)
+	}
+	switch options.FailurePolicy {
+	case "", FailurePolicyClosed, FailurePolicyOpen:
+	default:
+		return fmt.Errorf("--failure-policy must be %v or %v", FailurePolicyClosed, FailurePolicyOpen)
+	}
+	if options.Placeholder != "" && options.Placeholder != PlaceholderJavaAgent {
+		return fmt.Errorf("--placeholder must be %v", PlaceholderJavaAgent)
+	}
+	if options.Retries < 0 || options.Size < 0 {
+		return fmt.Errorf("--retries and --size can't be negative")
+	}
+	return nil
+}
+
+// Fetch downloads the agent to the output file, retrying failed downloads with exponential backoff. The agent is
+// written to a temporary file that is only renamed to the output file once it has been verified, so a failed
+// download never leaves a partial or empty agent behind.
+func Fetch(ctx context.Context, options Options) error {
+	client := options.Client
+	if client == nil {
+		client = &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+			},
+		}
+	}
+
+	directory := filepath.Dir(options.Output)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+
+	backoff := options.Backoff
+	var err error
+	for attempt := 0; attempt <= options.Retries; attempt++ {
+		if attempt > 0 {
+			log.WithError(err).WithFields(log.Fields{"attempt": attempt, "backoff": backoff.String()}).Warn("Retrying download")
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+		err = download(ctx, client, options)
+		var retryable retryableError
+		if err == nil || !errors.As(err, &retryable) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(options.Extract) != 0 {
+		defer os.Remove(options.Output)
+		if err := extract(options.Output, options.Extract); err != nil {
+			// A partially extracted agent must not be loaded
+			os.RemoveAll(options.Extract)
+			return err
+		}
+	}
+	return nil
+}
+
+func download(ctx context.Context, client *http.Client, options Options) error {
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, options.URL, nil)
+	if err != nil {
+		return err
+	}
+	if len(options.Username) != 0 {
+		request.SetBasicAuth(options.Username, options.Password)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return retryableError{err}
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError {
+		return retryableError{httpError{response.Status}}
+	}
+	if response.StatusCode != http.StatusOK {
+		return httpError{response.Status}
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(options.Output), "."+filepath.Base(options.Output)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(temp, io.TeeReader(response.Body, hash))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return retryableError{err}
+	}
+
+	// A truncated response is retried, a complete response that doesn't match is a verification failure
+	if response.ContentLength >= 0 && size != response.ContentLength {
+		return retryableError{fmt.Errorf("received %v of %v bytes", size, response.ContentLength)}
+	}
+	if size == 0 {
+		return verificationError{fmt.Errorf("agent is empty")}
+	}
+	if options.Size != 0 && size != options.Size {
+		return verificationError{fmt.Errorf("agent is %v bytes, expected %v", size, options.Size)}
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); len(options.SHA256) != 0 && !strings.EqualFold(checksum, options.SHA256) {
+		return verificationError{fmt.Errorf("agent SHA-256 is %v, expected %v", checksum, options.SHA256)}
+	}
+
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), options.Output)
+}
+
+// extract unzips archive into directory, rejecting entries that would be written outside of it
+func extract(archive, directory string) error {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return verificationError{fmt.Errorf("agent is not a valid zip archive: %v", err)}
+	}
+	defer reader.Close()
+
+	root := filepath.Clean(directory) + string(os.PathSeparator)
+	for _, file := range reader.File {
+		path := filepath.Join(directory, file.Name)
+		if !strings.HasPrefix(path, root) {
+			return verificationError{fmt.Errorf("archive entry %v is outside of %v", file.Name, directory)}
+		}
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := extractFile(file, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(file *zip.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	source, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destination, source); err != nil {
+		destination.Close()
+		return err
+	}
+	return destination.Close()
+}
@@ -0,0 +1,244 @@
+package fetch
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetch(t *testing.T) {
+	agent := []byte("contrast agent jar")
+	sum := sha256.Sum256(agent)
+	checksum := hex.EncodeToString(sum[:])
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requests++
+		// The first two attempts fail
+		if requests <= 2 {
+			http.Error(response, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		username, password, _ := request.BasicAuth()
+		assert.Equal(t, "user", username)
+		assert.Equal(t, "secret", password)
+		_, _ = response.Write(agent)
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "contrast.jar")
+	err := Fetch(context.Background(), Options{
+		URL:      server.URL,
+		Output:   output,
+		SHA256:   checksum,
+		Size:     int64(len(agent)),
+		Username: "user",
+		Password: "secret",
+		Retries:  3,
+		Backoff:  time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, requests)
+
+	written, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, agent, written)
+}
+
+func TestFetchErrors(t *testing.T) {
+	agent := []byte("contrast agent jar")
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		options  Options
+		expected int
+		requests int
+	}{
+		{
+			name: "retries exhausted",
+			handler: func(response http.ResponseWriter, request *http.Request) {
+				http.Error(response, "unavailable", http.StatusBadGateway)
+			},
+			options:  Options{Retries: 2},
+			expected: ExitDownloadFailed,
+			requests: 3,
+		},
+		{
+			name:     "not found is not retried",
+			handler:  http.NotFound,
+			options:  Options{Retries: 2},
+			expected: ExitDownloadFailed,
+			requests: 1,
+		},
+		{
+			name: "truncated response",
+			handler: func(response http.ResponseWriter, request *http.Request) {
+				response.Header().Set("Content-Length", strconv.Itoa(len(agent)+10))
+				_, _ = response.Write(agent)
+			},
+			options:  Options{Retries: 1},
+			expected: ExitDownloadFailed,
+			requests: 2,
+		},
+		{
+			name: "empty response",
+			handler: func(response http.ResponseWriter, request *http.Request) {
+				response.WriteHeader(http.StatusOK)
+			},
+			expected: ExitVerificationFailed,
+			requests: 1,
+		},
+		{
+			name: "checksum mismatch",
+			handler: func(response http.ResponseWriter, request *http.Request) {
+				_, _ = response.Write(agent)
+			},
+			options:  Options{SHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+			expected: ExitVerificationFailed,
+			requests: 1,
+		},
+		{
+			name: "size mismatch",
+			handler: func(response http.ResponseWriter, request *http.Request) {
+				_, _ = response.Write(agent)
+			},
+			options:  Options{Size: 1024},
+			expected: ExitVerificationFailed,
+			requests: 1,
+		},
+		{
+			name: "uninstrumented policy",
+			handler: func(response http.ResponseWriter, request *http.Request) {
+				_, _ = response.Write(agent)
+			},
+			options:  Options{SHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", Policy: PolicyUninstrumented},
+			expected: ExitOK,
+			requests: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				requests++
+				test.handler(response, request)
+			}))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "contrast.jar")
+			args := []string{"--url", server.URL, "--output", output, "--backoff", "1ms", "--retries", strconv.Itoa(test.options.Retries)}
+			if len(test.options.SHA256) != 0 {
+				args = append(args, "--sha256", test.options.SHA256)
+			}
+			if test.options.Size != 0 {
+				args = append(args, "--size", strconv.FormatInt(test.options.Size, 10))
+			}
+			if len(test.options.Policy) != 0 {
+				args = append(args, "--policy", test.options.Policy)
+			}
+
+			assert.Equal(t, test.expected, Run(args))
+			assert.Equal(t, test.requests, requests)
+			// A failed download never leaves an agent behind
+			assert.NoFileExists(t, output)
+			files, err := ioutil.ReadDir(filepath.Dir(output))
+			assert.NoError(t, err)
+			assert.Empty(t, files)
+		})
+	}
+
+	assert.Equal(t, ExitUsage, Run([]string{"--url", "https://example.com"}))
+	assert.Equal(t, ExitUsage, Run([]string{"--url", "https://example.com", "--output", "/tmp/agent", "--policy", "ignore"}))
+}
+
+func TestFetchExtract(t *testing.T) {
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	file, err := writer.Create("contentFiles/any/netstandard2.0/contrast/runtimes/linux-x64/native/ContrastProfiler.so")
+	assert.NoError(t, err)
+	_, err = file.Write([]byte("profiler"))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	var malicious bytes.Buffer
+	writer = zip.NewWriter(&malicious)
+	_, err = writer.Create("../../etc/profile")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/malicious.nupkg" {
+			_, _ = response.Write(malicious.Bytes())
+			return
+		}
+		_, _ = response.Write(archive.Bytes())
+	}))
+	defer server.Close()
+
+	directory := t.TempDir()
+	output := filepath.Join(directory, "contrast.nupkg")
+	extract := filepath.Join(directory, "dotnet-core")
+	err = Fetch(context.Background(), Options{URL: server.URL + "/contrast.nupkg", Output: output, Extract: extract})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, output)
+	assert.FileExists(t, filepath.Join(extract, "contentFiles/any/netstandard2.0/contrast/runtimes/linux-x64/native/ContrastProfiler.so"))
+
+	extract = filepath.Join(directory, "malicious")
+	err = Fetch(context.Background(), Options{URL: server.URL + "/malicious.nupkg", Output: output, Extract: extract})
+	assert.Error(t, err)
+	assert.NoFileExists(t, output)
+	_, err = os.Stat(extract)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFetchFailurePolicyOpen(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		http.Error(response, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "contrast.jar")
+	assert.Equal(t, ExitDownloadFailed, Run([]string{"--url", server.URL, "--output", output, "--retries", "0", "--placeholder", "javaagent"}))
+	assert.NoFileExists(t, output)
+
+	// The open failure policy always succeeds and writes the placeholder in place of the agent
+	assert.Equal(t, ExitOK, Run([]string{"--url", server.URL, "--output", output, "--retries", "0", "--placeholder", "javaagent", "--failure-policy", "open"}))
+	assert.FileExists(t, output)
+
+	assert.Equal(t, ExitOK, Run([]string{"--url", server.URL, "--failure-policy", "open"}))
+}
+
+func TestPlaceholderJavaAgent(t *testing.T) {
+	placeholder, err := placeholderJavaAgent()
+	assert.NoError(t, err)
+
+	reader, err := zip.NewReader(bytes.NewReader(placeholder), int64(len(placeholder)))
+	assert.NoError(t, err)
+	files := map[string][]byte{}
+	for _, file := range reader.File {
+		contents, err := file.Open()
+		assert.NoError(t, err)
+		files[file.Name], err = ioutil.ReadAll(contents)
+		assert.NoError(t, err)
+		contents.Close()
+	}
+
+	assert.Contains(t, string(files["META-INF/MANIFEST.MF"]), "Premain-Class: ContrastPlaceholderAgent\r\n")
+	class := files["ContrastPlaceholderAgent.class"]
+	assert.Equal(t, []byte{0xCA, 0xFE, 0xBA, 0xBE, 0x00, 0x00, 0x00, 0x31}, class[:8])
+	assert.True(t, bytes.Contains(class, []byte("(Ljava/lang/String;)V")))
+}
@@ -0,0 +1,135 @@
+package fetch
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// PlaceholderJavaAgent is a java agent that doesn't do anything, written in place of the agent when the application
+// starts without it, so -javaagent in JAVA_TOOL_OPTIONS doesn't stop the JVM from starting
+const PlaceholderJavaAgent = `javaagent`
+
+const placeholderJavaAgentClass = `ContrastPlaceholderAgent`
+
+// writePlaceholder writes the placeholder of kind to output atomically
+func writePlaceholder(kind, output string) error {
+	var placeholder []byte
+	switch kind {
+	case "":
+		return nil
+	case PlaceholderJavaAgent:
+		var err error
+		placeholder, err = placeholderJavaAgent()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown placeholder %v", kind)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(placeholder); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), output)
+}
+
+// placeholderJavaAgent returns a jar whose Premain-Class has an empty premain(String) method
+func placeholderJavaAgent() ([]byte, error) {
+	var jar bytes.Buffer
+	writer := zip.NewWriter(&jar)
+	manifest, err := writer.Create("META-INF/MANIFEST.MF")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(manifest, "Manifest-Version: 1.0\r\nPremain-Class: %v\r\n\r\n", placeholderJavaAgentClass); err != nil {
+		return nil, err
+	}
+	class, err := writer.Create(placeholderJavaAgentClass + ".class")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := class.Write(placeholderJavaAgentClassFile()); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return jar.Bytes(), nil
+}
+
+// placeholderJavaAgentClassFile assembles the class file of
+//
+//	public class ContrastPlaceholderAgent {
+//	    public static void premain(String args) {}
+//	}
+//
+// targeting Java 5, so it loads on every JVM the agent supports without a stack map
+func placeholderJavaAgentClassFile() []byte {
+	var class bytes.Buffer
+	u1 := func(value uint8) { class.WriteByte(value) }
+	u2 := func(value uint16) { _ = binary.Write(&class, binary.BigEndian, value) }
+	u4 := func(value uint32) { _ = binary.Write(&class, binary.BigEndian, value) }
+	utf8 := func(value string) {
+		u1(1)
+		u2(uint16(len(value)))
+		class.WriteString(value)
+	}
+
+	u4(0xCAFEBABE)
+	u2(0)  // minor version
+	u2(49) // major version, Java 5
+
+	u2(8) // constant pool count, entries are numbered from 1
+	u1(7) // #1 class
+	u2(2)
+	utf8(placeholderJavaAgentClass) // #2
+	u1(7)                           // #3 class
+	u2(4)
+	utf8("java/lang/Object")      // #4
+	utf8("premain")               // #5
+	utf8("(Ljava/lang/String;)V") // #6
+	utf8("Code")                  // #7
+
+	u2(0x0021) // public super
+	u2(1)      // this class
+	u2(3)      // super class
+	u2(0)      // interfaces
+	u2(0)      // fields
+
+	u2(1)      // methods
+	u2(0x0009) // public static
+	u2(5)      // name
+	u2(6)      // descriptor
+	u2(1)      // attributes
+	u2(7)      // Code
+	u4(13)     // attribute length
+	u2(0)      // max stack
+	u2(1)      // max locals, the args parameter
+	u4(1)      // code length
+	u1(0xb1)   // return
+	u2(0)      // exception table
+	u2(0)      // code attributes
+
+	u2(0) // class attributes
+	return class.Bytes()
+}
@@ -0,0 +1,222 @@
+// Package mergeconfig implements the merge-config command, which the init container injected for the
+// contrast-agent-injector/config-yaml and config-from annotations runs to merge the overrides of a Pod over the base
+// contrast_security.yaml.
+package mergeconfig
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// Exit codes of the merge-config command
+const (
+	ExitOK = iota
+	ExitUsage
+	ExitMergeFailed
+	ExitWriteFailed
+)
+
+const (
+	// FailurePolicyClosed exits with an error when the config can't be merged, so the Pod doesn't start
+	FailurePolicyClosed = `closed`
+	// FailurePolicyOpen writes the base config unchanged when the overrides can't be merged
+	FailurePolicyOpen = `open`
+)
+
+// Options configures how the config is merged
+type Options struct {
+	// Base is the contrast_security.yaml of the secret
+	Base string
+	// Output is the file the merged config is written to
+	Output string
+	// OverridesFile is a YAML fragment merged over the base config before the overrides, e.g. from a ConfigMap
+	OverridesFile string
+	// Overrides is the YAML fragment merged over the base config
+	Overrides string
+	// Protected are the top level sections of the base config the overrides can't change
+	Protected []string
+	// FailurePolicy is open or closed
+	FailurePolicy string
+}
+
+// Run parses the merge-config arguments, merges the config and returns the exit code. The overrides and failure
+// policy default to the env vars the webhook sets on the init container.
+func Run(args []string) int {
+	log.SetFormatter(&log.JSONFormatter{})
+	log.SetOutput(os.Stdout)
+	log.SetLevel(log.InfoLevel)
+
+	var options Options
+	flags := flag.NewFlagSet("merge-config", flag.ContinueOnError)
+	flags.StringVar(&options.Base, "base", "", "contrast_security.yaml the overrides are merged over")
+	flags.StringVar(&options.Output, "output", "", "File the merged contrast_security.yaml is written to")
+	flags.StringVar(&options.OverridesFile, "overrides-file", "", "File containing a YAML fragment merged over the base config before --overrides")
+	flags.StringVar(&options.Overrides, "overrides", os.Getenv("CONTRAST_CONFIG_OVERRIDES"), "YAML fragment merged over the base config")
+	protected := flags.String("protected", "", "Comma separated top level sections of the base config the overrides can't change")
+	flags.StringVar(&options.FailurePolicy, "failure-policy", os.Getenv("CONTRAST_FAILURE_POLICY"), "What happens when the config can't be merged, closed fails and open writes the base config unchanged")
+	if err := flags.Parse(args); err != nil {
+		log.Error(err)
+		return ExitUsage
+	}
+	if len(options.Base) == 0 || len(options.Output) == 0 {
+		log.Error("--base and --output are required")
+		return ExitUsage
+	}
+	for _, section := range strings.Split(*protected, ",") {
+		if section = strings.TrimSpace(section); len(section) != 0 {
+			options.Protected = append(options.Protected, section)
+		}
+	}
+
+	base, err := ioutil.ReadFile(options.Base)
+	if err != nil {
+		return options.failed(ExitMergeFailed, fmt.Errorf("could not read the base config: %v", err), nil)
+	}
+	merged := base
+	if len(options.OverridesFile) != 0 {
+		overrides, err := ioutil.ReadFile(options.OverridesFile)
+		if err != nil {
+			return options.failed(ExitMergeFailed, fmt.Errorf("could not read the config overrides: %v", err), base)
+		}
+		if merged, err = options.merge(merged, overrides); err != nil {
+			return options.failed(ExitMergeFailed, fmt.Errorf("%v: %v", options.OverridesFile, err), base)
+		}
+	}
+	merged, err = options.merge(merged, []byte(options.Overrides))
+	if err != nil {
+		return options.failed(ExitMergeFailed, err, base)
+	}
+	if err := write(options.Output, merged); err != nil {
+		log.Error(err)
+		return ExitWriteFailed
+	}
+	log.WithField("output", options.Output).Info("Merged the Contrast config overrides")
+	return ExitOK
+}
+
+// merge checks that overrides don't change the protected sections and merges them over base
+func (options Options) merge(base, overrides []byte) ([]byte, error) {
+	overrideConfig, err := ParseOverrides(overrides)
+	if err != nil {
+		return nil, err
+	}
+	if protected := ProtectedKeys(overrideConfig, options.Protected); len(protected) != 0 {
+		return nil, fmt.Errorf("the config overrides can't change the protected settings %v", strings.Join(protected, ", "))
+	}
+	return Merge(base, overrides)
+}
+
+// failed logs err and returns exitCode, or writes the base config unchanged with the open failure policy
+func (options Options) failed(exitCode int, err error, base []byte) int {
+	if options.FailurePolicy != FailurePolicyOpen {
+		log.WithField("exitCode", exitCode).Error(err)
+		return exitCode
+	}
+	log.WithField("exitCode", exitCode).Warn(err)
+	log.Warn("Starting the application without the Contrast config overrides")
+	if err := write(options.Output, base); err != nil {
+		log.WithError(err).Error("Could not write the base config")
+	}
+	return ExitOK
+}
+
+// write writes data to a temporary file that is renamed to output, so the agent never reads a partial config
+func write(output string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(output), ".contrast_security-*.yaml")
+	if err != nil {
+		return fmt.Errorf("could not write the merged config: %v", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("could not write the merged config: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("could not write the merged config: %v", err)
+	}
+	if err := os.Chmod(file.Name(), 0o444); err != nil {
+		return fmt.Errorf("could not write the merged config: %v", err)
+	}
+	if err := os.Rename(file.Name(), output); err != nil {
+		return fmt.Errorf("could not write the merged config: %v", err)
+	}
+	return nil
+}
+
+// Merge deep merges the YAML overrides over the YAML base. Maps are merged key by key, any other value of the
+// overrides replaces the value of the base, and a null removes the key from the base.
+func Merge(base, overrides []byte) ([]byte, error) {
+	var baseConfig map[string]interface{}
+	if err := yaml.Unmarshal(base, &baseConfig); err != nil {
+		return nil, fmt.Errorf("the base config is invalid: %v", err)
+	}
+	overrideConfig, err := ParseOverrides(overrides)
+	if err != nil {
+		return nil, err
+	}
+	if baseConfig == nil {
+		baseConfig = map[string]interface{}{}
+	}
+	merged, err := yaml.Marshal(merge(baseConfig, overrideConfig))
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal the merged config: %v", err)
+	}
+	return merged, nil
+}
+
+// ParseOverrides parses a YAML fragment of contrast_security.yaml, which must be a map
+func ParseOverrides(overrides []byte) (map[string]interface{}, error) {
+	var config interface{}
+	if err := yaml.Unmarshal(overrides, &config); err != nil {
+		return nil, fmt.Errorf("the config overrides are invalid: %v", err)
+	}
+	switch config := config.(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return config, nil
+	default:
+		return nil, fmt.Errorf("the config overrides must be a map of contrast_security.yaml settings")
+	}
+}
+
+func merge(base, overrides map[string]interface{}) map[string]interface{} {
+	for key, override := range overrides {
+		if override == nil {
+			delete(base, key)
+			continue
+		}
+		baseMap, baseIsMap := base[key].(map[string]interface{})
+		overrideMap, overrideIsMap := override.(map[string]interface{})
+		if baseIsMap && overrideIsMap {
+			base[key] = merge(baseMap, overrideMap)
+			continue
+		}
+		base[key] = override
+	}
+	return base
+}
+
+// ProtectedKeys returns the keys of overrides that change one of the protected top level sections, either as a
+// section or as a dotted key such as api.api_key. Keys are compared case insensitively.
+func ProtectedKeys(overrides map[string]interface{}, protected []string) []string {
+	var keys []string
+	for key := range overrides {
+		for _, section := range protected {
+			if strings.EqualFold(key, section) || strings.HasPrefix(strings.ToLower(key), strings.ToLower(section)+".") {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
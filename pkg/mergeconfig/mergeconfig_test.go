@@ -0,0 +1,124 @@
+package mergeconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const baseConfig = `
+api:
+  url: https://app.contrastsecurity.com/Contrast
+  api_key: key
+  service_key: service
+  user_name: agent
+server:
+  name: default
+  environment: production
+agent:
+  logger:
+    level: WARN
+    path: /tmp/contrast.log
+application:
+  tags: team-a
+`
+
+func TestMerge(t *testing.T) {
+	merged, err := Merge([]byte(baseConfig), []byte(`
+server:
+  environment: qa
+agent:
+  logger:
+    level: DEBUG
+    path: null
+  java:
+    scan_all_classes: true
+application:
+  tags: [team-a, payments]
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, `agent:
+  java:
+    scan_all_classes: true
+  logger:
+    level: DEBUG
+api:
+  api_key: key
+  service_key: service
+  url: https://app.contrastsecurity.com/Contrast
+  user_name: agent
+application:
+  tags:
+  - team-a
+  - payments
+server:
+  environment: qa
+  name: default
+`, string(merged))
+
+	merged, err = Merge([]byte(""), []byte("server:\n  name: webgoat\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "server:\n  name: webgoat\n", string(merged))
+
+	_, err = Merge([]byte(baseConfig), []byte("- server"))
+	assert.EqualError(t, err, "the config overrides must be a map of contrast_security.yaml settings")
+
+	_, err = Merge([]byte("api: [\n"), []byte("server:\n  name: webgoat\n"))
+	assert.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yaml")
+	output := filepath.Join(dir, "contrast_security.yaml")
+	assert.NoError(t, ioutil.WriteFile(base, []byte(baseConfig), 0o600))
+
+	assert.Equal(t, ExitOK, Run([]string{"--base", base, "--output", output, "--overrides", "server:\n  name: webgoat\n"}))
+	merged, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Contains(t, string(merged), "name: webgoat")
+	assert.Contains(t, string(merged), "api_key: key")
+
+	assert.Equal(t, ExitUsage, Run([]string{"--output", output}))
+	assert.Equal(t, ExitMergeFailed, Run([]string{"--base", base, "--output", output, "--overrides", "- server"}))
+
+	// The open failure policy writes the base config unchanged
+	assert.NoError(t, os.Remove(output))
+	assert.Equal(t, ExitOK, Run([]string{"--base", base, "--output", output, "--overrides", "- server", "--failure-policy", "open"}))
+	merged, err = ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, baseConfig, string(merged))
+}
+
+func TestRunOverridesFile(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yaml")
+	overridesFile := filepath.Join(dir, "overrides.yaml")
+	output := filepath.Join(dir, "contrast_security.yaml")
+	assert.NoError(t, ioutil.WriteFile(base, []byte(baseConfig), 0o600))
+	assert.NoError(t, ioutil.WriteFile(overridesFile, []byte("server:\n  name: from-file\n  environment: qa\n"), 0o600))
+
+	// The overrides are merged after the overrides file
+	assert.Equal(t, ExitOK, Run([]string{"--base", base, "--output", output, "--overrides-file", overridesFile, "--overrides", "server:\n  name: webgoat\n", "--protected", "api"}))
+	merged, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Contains(t, string(merged), "name: webgoat")
+	assert.Contains(t, string(merged), "environment: qa")
+
+	assert.NoError(t, ioutil.WriteFile(overridesFile, []byte("api:\n  api_key: other\n"), 0o600))
+	assert.Equal(t, ExitMergeFailed, Run([]string{"--base", base, "--output", output, "--overrides-file", overridesFile, "--protected", "api"}))
+	assert.Equal(t, ExitMergeFailed, Run([]string{"--base", base, "--output", output, "--overrides", "Api.api_key: other", "--protected", "api"}))
+	assert.Equal(t, ExitOK, Run([]string{"--base", base, "--output", output, "--overrides-file", overridesFile}))
+	merged, err = ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Contains(t, string(merged), "api_key: other")
+}
+
+func TestProtectedKeys(t *testing.T) {
+	overrides := map[string]interface{}{"api": nil, "API.url": "x", "apiary": "y", "server": nil}
+	assert.Equal(t, []string{"API.url", "api"}, ProtectedKeys(overrides, []string{"api"}))
+	assert.Empty(t, ProtectedKeys(overrides, nil))
+}
@@ -1,6 +1,7 @@
 package webhooks
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 
@@ -9,109 +10,548 @@ import (
 )
 
 const (
-	javaLanguage               = `java`
 	injectorVersionAnnotation  = `contrast-agent-injector/version`
 	injectorLanguageAnnotation = `contrast-agent-injector/language`
 	injectorConfigAnnotation   = `contrast-agent-injector/config`
+	// injectorContainerAnnotation is a comma separated list of the containers to inject the agent into,
+	// defaults to the first container
+	injectorContainerAnnotation = `contrast-agent-injector/container`
+	// injectorInjectAllAnnotation injects the agent into every container that isn't excluded
+	injectorInjectAllAnnotation = `contrast-agent-injector/inject-all`
+	// injectorExcludeContainersAnnotation is a comma separated list of containers excluded from inject-all,
+	// in addition to defaultExcludedContainers
+	injectorExcludeContainersAnnotation = `contrast-agent-injector/exclude-containers`
+	// injectorDeliveryAnnotation overrides the delivery mode configured for the injector, download or image
+	injectorDeliveryAnnotation = `contrast-agent-injector/delivery`
+	// injectorFailurePolicyAnnotation overrides the failure policy configured for the injector, open or closed
+	injectorFailurePolicyAnnotation = `contrast-agent-injector/failure-policy`
+	// injectorResolvedVersionAnnotation records the version latest or a version range resolved to, per container
+	injectorResolvedVersionAnnotation = `contrast-agent-injector/resolved-version`
+	agentInitContainerName            = `contrast-agent-injector`
 )
 
-type Agent interface {
-	GeneratePatches() []patchOperation
-}
+const (
+	// FailurePolicyClosed stops the Pod from starting when the init container can't stage the agent
+	FailurePolicyClosed = `closed`
+	// FailurePolicyOpen starts the application without the agent when the init container can't stage it,
+	// the init container always succeeds and the flags loading the agent are inert
+	FailurePolicyOpen = `open`
+)
+
+// defaultExcludedContainers are well known sidecars that are never injected in inject-all mode
+var defaultExcludedContainers = []string{"istio-proxy", "linkerd-proxy", "vault-agent"}
 
 type AgentPatch struct {
-	pod        corev1.Pod
-	secretName string
+	pod          corev1.Pod
+	secretName   string
+	agents       AgentRegistry
+	deliveryMode string
+	verifier     *ArtifactVerifier
+	resolver     *VersionResolver
+	// artifactCacheURL is the URL of the injector's artifact cache, agents are downloaded from upstream when it is empty
+	artifactCacheURL string
+	// injectorImage is the image of the injector, used by init containers downloading the agent with fetch-agent
+	injectorImage string
+	failurePolicy string
+	// initContainerResources are the default requests and limits of init containers
+	initContainerResources *corev1.ResourceRequirements
+	// initContainerUser is the user init containers run as when the Pod doesn't set one
+	initContainerUser int64
+	// allowConfigAPIOverrides allows the config-yaml annotation to override the api settings of the secret
+	allowConfigAPIOverrides bool
+	// namespace is the namespace of the Pod, ConfigMaps referenced by config-from are looked up in it
+	namespace string
+	// configMaps checks that the ConfigMaps referenced by config-from exist, if set
+	configMaps ConfigMapLister
+	// warnings collects the decisions reported to the user in the admission response, if set
+	warnings *[]string
 }
 
 type AgentAnnotations struct {
-	version      *string
-	language     *string
-	envVarConfig []corev1.EnvVar
+	version       *string
+	language      *string
+	failurePolicy *string
+	envVarConfig  []corev1.EnvVar
 }
 
-type JavaAgentConfig struct {
-	version        *string
-	secretName     *string
-	envVarConfig   []corev1.EnvVar
-	initContainers []corev1.Container
-	volumes        []corev1.Volume
-	containers     []corev1.Container
+// AgentConfig is the configuration for injecting the agent described by definition into a container
+type AgentConfig struct {
+	definition AgentDefinition
+	version    *string
+	// versionRange is the annotated version when a different version is injected: latest or a version range that
+	// was resolved, or a version the version policy rewrote to its default version
+	versionRange     string
+	deliveryMode     string
+	verifier         *ArtifactVerifier
+	artifactCacheURL string
+	injectorImage    string
+	failurePolicy    string
+	resources        corev1.ResourceRequirements
+	securityContext  *corev1.SecurityContext
+	annotations      map[string]string
+	envVarConfig     []corev1.EnvVar
+	// envFrom are the ConfigMaps referenced by config-from, injected as env vars
+	envFrom        []corev1.EnvFromSource
+	container      corev1.Container
+	containerIndex int
 }
 
 func (agentPatch AgentPatch) GenerateAgentPatches() ([]patchOperation, error) {
-	var agentAnnotations AgentAnnotations
-	err := parseValuesFromAnnotations(agentPatch.pod.Annotations, &agentAnnotations)
+	agents := agentPatch.agents
+	if agents == nil {
+		agents = defaultAgentRegistry
+	}
+
+	verifier := agentPatch.verifier
+	if verifier == nil {
+		verifier = defaultArtifactVerifier
+	}
+
+	resolver := agentPatch.resolver
+	if resolver == nil {
+		resolver = defaultVersionResolver
+	}
+
+	injectorImage := agentPatch.injectorImage
+	if len(injectorImage) == 0 {
+		injectorImage = DefaultInjectorImage
+	}
+
+	annotations := agentPatch.pod.Annotations
+	deliveryMode := agentPatch.deliveryMode
+	if delivery, ok := annotations[injectorDeliveryAnnotation]; ok {
+		deliveryMode = strings.ToLower(delivery)
+	}
+	if len(deliveryMode) == 0 {
+		deliveryMode = DeliveryDownload
+	}
+
+	defaultResources := DefaultInitContainerResources()
+	if agentPatch.initContainerResources != nil {
+		defaultResources = *agentPatch.initContainerResources
+	}
+	resources, err := initContainerResources(defaultResources, annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	initContainerUser := agentPatch.initContainerUser
+	if initContainerUser == 0 {
+		initContainerUser = DefaultInitContainerUser
+	}
+	securityContext := initContainerSecurityContext(agentPatch.pod.Spec.SecurityContext, initContainerUser)
+
+	containerIndexes, injectAll, err := targetContainerIndexes(agentPatch.pod.Spec.Containers, annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	var agentConfigs []AgentConfig
+	for _, containerIndex := range containerIndexes {
+		container := agentPatch.pod.Spec.Containers[containerIndex]
+
+		var agentAnnotations AgentAnnotations
+		err := parseValuesFromAnnotations(annotations, container.Name, &agentAnnotations)
+		if err != nil {
+			return nil, err
+		}
+
+		failurePolicy := agentPatch.failurePolicy
+		if agentAnnotations.failurePolicy != nil {
+			failurePolicy = *agentAnnotations.failurePolicy
+		}
+		if len(failurePolicy) == 0 {
+			failurePolicy = FailurePolicyClosed
+		}
+		if failurePolicy != FailurePolicyClosed && failurePolicy != FailurePolicyOpen {
+			return nil, fmt.Errorf("%v must be %v or %v", injectorFailurePolicyAnnotation, FailurePolicyClosed, FailurePolicyOpen)
+		}
+
+		language := strings.ToLower(*agentAnnotations.language)
+		if len(language) == 0 || language == autoLanguage {
+			language, err = agents.detectLanguage(container)
+			if err != nil && injectAll {
+				log.Infof("Skipping container %v: %v", container.Name, err)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		definition, ok := agents[language]
+		if !ok {
+			return nil, fmt.Errorf("Language %v not supported", *agentAnnotations.language)
+		}
+
+		if err := validateVersion(*agentAnnotations.version); err != nil {
+			return nil, fmt.Errorf("%v is invalid: %v", injectorVersionAnnotation, err)
+		}
+		version, err := resolver.resolve(definition, *agentAnnotations.version)
+		if err != nil {
+			return nil, err
+		}
+		// Resolved versions come from the artifact repository and are validated like the annotation
+		if err := validateVersion(version); err != nil {
+			return nil, fmt.Errorf("%v agent version resolved from %v is invalid: %v", language, *agentAnnotations.version, err)
+		}
+		if reason := definition.VersionPolicy.check(version); len(reason) != 0 {
+			if definition.VersionPolicy.Action != VersionPolicyRewrite {
+				return nil, fmt.Errorf("Skipping mutation: %v agent version %v of container %v %v", language, version, container.Name, reason)
+			}
+			agentPatch.warn("%v agent version %v of container %v %v, injecting the default version %v instead",
+				language, version, container.Name, reason, definition.VersionPolicy.DefaultVersion)
+			version = definition.VersionPolicy.DefaultVersion
+		}
+		var versionRange string
+		if version != *agentAnnotations.version {
+			versionRange = *agentAnnotations.version
+		}
+
+		agentConfigs = append(agentConfigs, AgentConfig{
+			definition:       definition,
+			version:          &version,
+			versionRange:     versionRange,
+			deliveryMode:     deliveryMode,
+			verifier:         verifier,
+			artifactCacheURL: agentPatch.artifactCacheURL,
+			injectorImage:    injectorImage,
+			failurePolicy:    failurePolicy,
+			resources:        resources,
+			securityContext:  securityContext,
+			annotations:      annotations,
+			envVarConfig:     agentAnnotations.envVarConfig,
+			container:        container,
+			containerIndex:   containerIndex,
+		})
+	}
+
+	if len(agentConfigs) == 0 {
+		return nil, fmt.Errorf("no containers to inject the agent into")
+	}
+
+	containerNames := make([]string, 0, len(agentConfigs))
+	for _, config := range agentConfigs {
+		containerNames = append(containerNames, config.container.Name)
+	}
+	sources, err := configFromSources(annotations, containerNames)
 	if err != nil {
 		return nil, err
 	}
+	merge := configMerge{protectAPI: !agentPatch.allowConfigAPIOverrides}
+	for _, source := range sources {
+		if err := agentPatch.checkConfigMap(source); err != nil {
+			return nil, err
+		}
+		if len(source.key) != 0 {
+			configMap := source
+			merge.configMap = &configMap
+			continue
+		}
+		for i := range agentConfigs {
+			if source.annotation == injectorConfigFromAnnotation || source.annotation == containerAnnotation(injectorConfigFromAnnotation, agentConfigs[i].container.Name) {
+				agentConfigs[i].envFrom = append(agentConfigs[i].envFrom, source.envFrom())
+			}
+		}
+	}
+
+	overrides, hasOverrides := annotations[injectorConfigYAMLAnnotation]
+	if hasOverrides {
+		if err := validateConfigYAMLAnnotation(overrides, agentPatch.allowConfigAPIOverrides); err != nil {
+			return nil, err
+		}
+		merge.overrides = overrides
+	}
+	var configContainer *corev1.Container
+	var configVolumes []corev1.Volume
+	if hasOverrides || merge.configMap != nil {
+		// The Pod only starts without the overrides when every agent may start without being staged
+		failurePolicy := FailurePolicyOpen
+		for _, config := range agentConfigs {
+			if config.failurePolicy != FailurePolicyOpen {
+				failurePolicy = FailurePolicyClosed
+			}
+		}
+		var container corev1.Container
+		container, configVolumes = merge.render(injectorImage, failurePolicy)
+		container.Resources = resources
+		container.SecurityContext = securityContext
+		configContainer = &container
+	}
+
+	return generatePatches(agentPatch.pod, agentPatch.secretName, agentConfigs, configContainer, configVolumes)
+}
+
+// warn logs a decision made about the Pod and reports it in the admission response
+func (agentPatch AgentPatch) warn(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	log.Info(warning)
+	if agentPatch.warnings != nil {
+		*agentPatch.warnings = append(*agentPatch.warnings, warning)
+	}
+}
+
+// generatePatches combines the agents injected into each container into a single patch. Volumes are only
+// added once, and containers using the same agent with the same init container settings share the init container
+// that stages it. Every init container stages its agent into its own sub path of the agent volume, so agents for
+// different languages, versions or settings don't collide.
+// When configContainer is set it merges the config overrides of the Pod, and the agents load the merged config.
+func generatePatches(pod corev1.Pod, secretName string, agentConfigs []AgentConfig, configContainer *corev1.Container, configVolumes []corev1.Volume) ([]patchOperation, error) {
 	var patches []patchOperation
-	var agent Agent
-	switch strings.ToLower(*agentAnnotations.language) {
-	case javaLanguage:
-		agent = JavaAgentConfig{
-			version:        agentAnnotations.version,
-			initContainers: agentPatch.pod.Spec.InitContainers,
-			volumes:        agentPatch.pod.Spec.Volumes,
-			containers:     agentPatch.pod.Spec.Containers,
-			secretName:     &agentPatch.secretName,
-			envVarConfig:   agentAnnotations.envVarConfig,
-		}
-		patches = agent.GeneratePatches()
-	default:
-		return nil, fmt.Errorf("Language %v not supported", *agentAnnotations.language)
+
+	volumeDefinition := append(agentVolumes(secretName), configVolumes...)
+	var initContainerDefinition []corev1.Container
+	stagedAgents := map[string]string{}
+	volumeMountDefinitions := map[int][]corev1.VolumeMount{}
+	envVarDefinitions := map[int][]corev1.EnvVar{}
+
+	for _, config := range agentConfigs {
+		initContainer, envVars, err := config.render()
+		if err != nil {
+			return nil, err
+		}
+
+		stagedAgent, err := stagedAgentKey(config, initContainer)
+		if err != nil {
+			return nil, err
+		}
+		initContainerName, staged := stagedAgents[stagedAgent]
+		if !staged {
+			initContainerName = agentInitContainerName
+			if len(initContainerDefinition) > 0 {
+				initContainerName = fmt.Sprintf("%v-%v", agentInitContainerName, len(initContainerDefinition)+1)
+			}
+			initContainer.Name = initContainerName
+			initContainer.VolumeMounts = append([]corev1.VolumeMount{agentVolumeMounts(initContainerName)[0], initContainerTmpVolumeMount()}, initContainer.VolumeMounts...)
+			initContainerDefinition = append(initContainerDefinition, initContainer)
+			stagedAgents[stagedAgent] = initContainerName
+		}
+
+		for _, volume := range config.definition.Volumes {
+			if !containsVolume(volumeDefinition, volume.Name) {
+				volumeDefinition = append(volumeDefinition, volume)
+			}
+		}
+		volumeMountDefinitions[config.containerIndex] = append(agentVolumeMounts(initContainerName), config.definition.VolumeMounts...)
+		if configContainer != nil {
+			volumeMountDefinitions[config.containerIndex] = append(volumeMountDefinitions[config.containerIndex], mergedConfigVolumeMount())
+			envVars = setEnvVar(envVars, "CONTRAST_CONFIG_PATH", mergedConfigPath+"/contrast_security.yaml")
+		}
+		// The config annotations replace the env vars of the agent they set, the Pod never gets an env var twice
+		for _, envVar := range config.envVarConfig {
+			envVars = setEnvVar(envVars, envVar.Name, envVar.Value)
+		}
+		envVarDefinitions[config.containerIndex] = envVars
+	}
+	if configContainer != nil {
+		initContainerDefinition = append(initContainerDefinition, *configContainer)
+	}
+
+	log.Info("Generating patches for agent configuration")
+	patches = append(patches, addVolumes(pod.Spec.Volumes, volumeDefinition, "/spec/volumes")...)
+	patches = append(patches, addInitContainer(pod.Spec.InitContainers, initContainerDefinition, "/spec/initContainers")...)
+	for _, config := range agentConfigs {
+		containerPath := fmt.Sprintf("/spec/containers/%v", config.containerIndex)
+		patches = append(patches, addVolumeMounts(config.container.VolumeMounts, volumeMountDefinitions[config.containerIndex], containerPath+"/volumeMounts")...)
+		patches = append(patches, addEnvVars(config.container.Env, envVarDefinitions[config.containerIndex], containerPath+"/env")...)
+		patches = append(patches, addEnvFrom(config.container.EnvFrom, config.envFrom, containerPath+"/envFrom")...)
+	}
+	for _, config := range agentConfigs {
+		if len(config.versionRange) == 0 {
+			continue
+		}
+		annotation := containerAnnotation(injectorResolvedVersionAnnotation, config.container.Name)
+		patches = append(patches, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations/" + escapeJSONPointer(annotation),
+			Value: *config.version,
+		})
 	}
 
 	return patches, nil
 }
 
-func (config JavaAgentConfig) GeneratePatches() []patchOperation {
-	var patches []patchOperation
+// stagedAgentKey identifies the init container staging an agent. Containers only share an init container when
+// everything it runs with matches, including the failure policy and verification env vars, resources and
+// security context.
+func stagedAgentKey(config AgentConfig, initContainer corev1.Container) (string, error) {
+	key, err := json.Marshal(struct {
+		Language        string
+		Version         string
+		Image           string
+		Command         []string
+		Args            []string
+		Env             []corev1.EnvVar
+		Resources       corev1.ResourceRequirements
+		SecurityContext *corev1.SecurityContext
+	}{
+		Language:        config.definition.Language,
+		Version:         *config.version,
+		Image:           initContainer.Image,
+		Command:         initContainer.Command,
+		Args:            initContainer.Args,
+		Env:             initContainer.Env,
+		Resources:       initContainer.Resources,
+		SecurityContext: initContainer.SecurityContext,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not render agent definition for %v: %v", config.definition.Language, err)
+	}
+	return string(key), nil
+}
 
-	// TODO: Need to figure out which container to choose (maybe the first is just a limitation to document)
-	containerToInject := config.containers[0]
+// render returns the init container staging the agent and the env vars loading it into the container
+func (config AgentConfig) render() (corev1.Container, []corev1.EnvVar, error) {
+	data := agentTemplateData{
+		Version:        *config.version,
+		ContainerName:  config.container.Name,
+		ContainerImage: config.container.Image,
+		InjectorImage:  config.injectorImage,
+	}
+	definition := config.definition
+	if config.useArtifactCache() {
+		// The cache serves the agent without credentials, ValidateArtifactCache rejects caches for mirrors that need them
+		artifact := *definition.Artifact
+		artifact.URL = cacheArtifactURL(config.artifactCacheURL, definition.Language)
+		artifact.CredentialsSecret = ""
+		definition.Artifact = &artifact
+	}
+	initContainer, envVars, err := definition.render(data, config.container.Env, config.annotations, config.deliveryMode)
+	if err != nil {
+		return corev1.Container{}, nil, fmt.Errorf("could not render agent definition for %v: %v", config.definition.Language, err)
+	}
 
-	// TODO: Make this a configmap
-	// TODO: Use image that is pre built with the agent in it
-	// TODO: Add resources
-	initContainerDefinition := []corev1.Container{
-		{
-			Name:    "contrast-agent-injector",
-			Image:   "busybox:1.34.0",
-			Command: []string{"/bin/sh", "-c"},
-			Args: []string{
-				fmt.Sprintf(`echo downloading Contrast agent;
-				DOWNLOAD_URL_AGENT_JAVA="https://repository.sonatype.org/service/local/artifact/maven/redirect?r=central-proxy&g=com.contrastsecurity&a=contrast-agent&v=%v"
-				wget -q -O /opt/contrast/contrast.jar $DOWNLOAD_URL_AGENT_JAVA;
-				echo finished downloading Contrast agent;`, strings.ToUpper(*config.version)),
-			},
-			VolumeMounts: []corev1.VolumeMount{
-				{
-					Name:      "contrast-agent-injector",
-					MountPath: "/opt/contrast",
-				},
-			},
-		},
+	// Agent images are trusted, only downloaded agents are verified
+	if config.definition.Artifact != nil && config.deliveryMode == DeliveryDownload {
+		verificationEnvVars, err := config.verifier.verificationEnvVars(*config.definition.Artifact, data)
+		if err != nil {
+			return corev1.Container{}, nil, err
+		}
+		initContainer.Env = append(initContainer.Env, verificationEnvVars...)
 	}
 
-	volumeDefinition := []corev1.Volume{
+	if config.failurePolicy == FailurePolicyOpen {
+		initContainer.Env = append(initContainer.Env, corev1.EnvVar{
+			Name:  "CONTRAST_FAILURE_POLICY",
+			Value: FailurePolicyOpen,
+		})
+	}
+
+	initContainer.Resources = config.resources
+	initContainer.SecurityContext = config.securityContext
+
+	return initContainer, envVars, nil
+}
+
+// useArtifactCache returns true if the agent is downloaded from the injector's artifact cache. Versions that aren't
+// pinned are downloaded from upstream, since the cache could serve an outdated agent for them.
+func (config AgentConfig) useArtifactCache() bool {
+	return len(config.artifactCacheURL) != 0 && config.deliveryMode == DeliveryDownload && cacheable(config.definition) && !isVersionRange(*config.version)
+}
+
+// targetContainerIndexes returns the indexes of the containers to inject the agent into: every container that
+// isn't excluded in inject-all mode, otherwise the containers named in the container annotation and the containers
+// with their own language annotation, falling back to the first container
+func targetContainerIndexes(containers []corev1.Container, annotations map[string]string) ([]int, bool, error) {
+	var indexes []int
+	switch strings.ToLower(annotations[injectorInjectAllAnnotation]) {
+	case "true", "enabled":
+		excluded := append(append([]string{}, defaultExcludedContainers...), splitCommaSeparatedString(annotations[injectorExcludeContainersAnnotation])...)
+		for index, container := range containers {
+			if containsString(excluded, container.Name) {
+				log.Infof("Skipping excluded container %v", container.Name)
+				continue
+			}
+			indexes = append(indexes, index)
+		}
+		return indexes, true, nil
+	}
+
+	names := splitCommaSeparatedString(annotations[injectorContainerAnnotation])
+	for _, name := range names {
+		index, err := containerIndex(containers, name)
+		if err != nil {
+			return nil, false, err
+		}
+		indexes = append(indexes, index)
+	}
+	for index, container := range containers {
+		_, hasLanguage := annotations[containerAnnotation(injectorLanguageAnnotation, container.Name)]
+		if hasLanguage && !containsString(names, container.Name) {
+			indexes = append(indexes, index)
+		}
+	}
+	if len(indexes) == 0 {
+		indexes = []int{0}
+	}
+	return indexes, false, nil
+}
+
+func containerIndex(containers []corev1.Container, name string) (int, error) {
+	for index, container := range containers {
+		if container.Name == name {
+			return index, nil
+		}
+	}
+	return 0, fmt.Errorf("container %v set in %v not found in the Pod", name, injectorContainerAnnotation)
+}
+
+// containerAnnotation returns the per container variant of an annotation, e.g. contrast-agent-injector/version.<container>
+func containerAnnotation(annotation, containerName string) string {
+	return fmt.Sprintf("%v.%v", annotation, containerName)
+}
+
+// escapeJSONPointer escapes a key for use as a JSON patch path segment
+func escapeJSONPointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsVolume(volumes []corev1.Volume, name string) bool {
+	for _, volume := range volumes {
+		if volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// agentVolumes returns the volumes shared by every agent: an emptyDir the agent is staged
+// into and the secret containing the contrast_security.yaml file
+func agentVolumes(secretName string) []corev1.Volume {
+	return []corev1.Volume{
 		{
 			Name: "contrast-agent-injector",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
 		},
 		{
 			Name: "contrast-agent-injector-yaml",
 			VolumeSource: corev1.VolumeSource{
 				Secret: &corev1.SecretVolumeSource{
-					SecretName: *config.secretName,
+					SecretName: secretName,
 				},
 			},
 		},
 	}
+}
 
-	volumeMountDefinition := []corev1.VolumeMount{
+// agentVolumeMounts returns the volume mounts for the volumes defined in agentVolumes,
+// mounting the sub path of the agent volume an agent was staged into at /opt/contrast
+func agentVolumeMounts(subPath string) []corev1.VolumeMount {
+	return []corev1.VolumeMount{
 		{
 			Name:      "contrast-agent-injector",
 			MountPath: "/opt/contrast",
+			SubPath:   subPath,
 		},
 		{
 			Name:      "contrast-agent-injector-yaml",
@@ -119,84 +559,73 @@ func (config JavaAgentConfig) GeneratePatches() []patchOperation {
 			SubPath:   "contrast_security.yaml",
 		},
 	}
+}
 
-	envVarDefinitions := []corev1.EnvVar{
-		{
-			Name:  "JAVA_TOOL_OPTIONS",
-			Value: "-javaagent:/opt/contrast/contrast.jar",
-		},
-		{
-			Name:  "CONTRAST_CONFIG_PATH",
-			Value: "/opt/contrast/contrast_security.yaml",
-		},
-		{
-			Name:  "CONTRAST__AGENT__JAVA__STANDALONE_APP_NAME",
-			Value: containerToInject.Name,
-		},
+// initContainerTmpVolumeMount returns a writable /tmp for init containers, which have a read only root file system.
+// It is the hidden .tmp directory of the agent volume, emptyDir volumes are writable by every user.
+func initContainerTmpVolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      "contrast-agent-injector",
+		MountPath: "/tmp",
+		SubPath:   ".tmp",
 	}
+}
 
-	envVarDefinitions = append(envVarDefinitions, config.envVarConfig...)
+// parseValuesFromAnnotations reads the agent configuration for a container, per container annotations
+// such as contrast-agent-injector/version.<container> take precedence over the annotations for the Pod
+func parseValuesFromAnnotations(annotations map[string]string, containerName string, agentConfig *AgentAnnotations) error {
+	lookup := func(annotation string) (string, bool) {
+		if value, ok := annotations[containerAnnotation(annotation, containerName)]; ok {
+			return value, ok
+		}
+		value, ok := annotations[annotation]
+		return value, ok
+	}
 
-	log.Info("Generating patches for agent configuration")
-	patches = append(patches, addVolumes(config.volumes, volumeDefinition, "/spec/volumes")...)
-	patches = append(patches, addInitContainer(config.initContainers, initContainerDefinition, "/spec/initContainers")...)
-	patches = append(patches, addVolumeMounts(containerToInject.VolumeMounts, volumeMountDefinition, "/spec/containers/0/volumeMounts")...)
-	patches = append(patches, addEnvVars(containerToInject.Env, envVarDefinitions, "/spec/containers/0/env")...)
+	if failurePolicy, ok := lookup(injectorFailurePolicyAnnotation); ok {
+		failurePolicy = strings.ToLower(failurePolicy)
+		agentConfig.failurePolicy = &failurePolicy
+	}
 
-	return patches
-}
+	language, languageAnnotationExists := lookup(injectorLanguageAnnotation)
+	version, versionAnnotationExists := lookup(injectorVersionAnnotation)
+	if !versionAnnotationExists {
+		log.Info("Version annotation must be set")
 
-func parseValuesFromAnnotations(annotations map[string]string, agentConfig *AgentAnnotations) error {
-	language, languageAnnotationExists := annotations[injectorLanguageAnnotation]
-	version, versionAnnotationExists := annotations[injectorVersionAnnotation]
-	config, configAnnotationExists := annotations[injectorConfigAnnotation]
-	if !languageAnnotationExists && !versionAnnotationExists {
-		log.Info("Language and version labels must be set")
+		return fmt.Errorf("%v needs to be set", injectorVersionAnnotation)
+	}
 
-		return fmt.Errorf("both %v or %v need to be set", injectorLanguageAnnotation, injectorVersionAnnotation)
+	// A missing language annotation is detected from the target container
+	if !languageAnnotationExists {
+		language = autoLanguage
 	}
 
 	agentConfig.language = &language
 	agentConfig.version = &version
 
-	if agentConfig.language == nil || agentConfig.version == nil {
-		return fmt.Errorf("both %v or %v need to be set", injectorLanguageAnnotation, injectorVersionAnnotation)
+	// Per container config is added to the config for the Pod, and replaces the env vars the Pod's config sets.
+	// config-json is applied after config.
+	configAnnotations := []struct {
+		name  string
+		parse func(annotation, config string) ([]corev1.EnvVar, error)
+	}{
+		{injectorConfigAnnotation, parseConfigAnnotation},
+		{containerAnnotation(injectorConfigAnnotation, containerName), parseConfigAnnotation},
+		{injectorConfigJSONAnnotation, parseConfigJSONAnnotation},
+		{containerAnnotation(injectorConfigJSONAnnotation, containerName), parseConfigJSONAnnotation},
 	}
-
-	if configAnnotationExists {
-		err := parseConfigAnnotation(config, &agentConfig.envVarConfig)
+	for _, annotation := range configAnnotations {
+		config, configAnnotationExists := annotations[annotation.name]
+		if !configAnnotationExists {
+			continue
+		}
+		envVars, err := annotation.parse(annotation.name, config)
 		if err != nil {
 			return err
 		}
-	}
-
-	return nil
-}
-
-func parseConfigAnnotation(config string, value *[]corev1.EnvVar) error {
-	kvPairs := splitCommaSeparatedString(config)
-	// envVars := []corev1.EnvVar{}
-	var envVars []corev1.EnvVar
-	for _, kvPair := range kvPairs {
-		parts := strings.SplitN(kvPair, "=", 2)
-		if len(parts) != 2 {
-			return fmt.Errorf("failed to parse stringMap annotation, %v: %v", injectorConfigAnnotation, config)
-		}
-		key := parts[0]
-		value := parts[1]
-		if len(key) == 0 {
-			return fmt.Errorf("failed to parse stringMap annotation, %v: %v", injectorConfigAnnotation, config)
-		}
-		envVar := []corev1.EnvVar{
-			{
-				Name:  key,
-				Value: value,
-			},
+		for _, envVar := range envVars {
+			agentConfig.envVarConfig = setEnvVar(agentConfig.envVarConfig, envVar.Name, envVar.Value)
 		}
-		envVars = append(envVars, envVar...)
-	}
-	if value != nil {
-		*value = envVars
 	}
 
 	return nil
@@ -1,7 +1,13 @@
 package webhooks
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
@@ -58,13 +64,13 @@ metadata:
   labels:
     app: webgoat
   annotations:
-    contrast-agent-injector/language: python
+    contrast-agent-injector/language: php
     contrast-agent-injector/version: 3.8.7.21531
     contrast-agent-injector/enabled: "true"
 spec:
   containers:
-  - name: flask
-    image: flask
+  - name: wordpress
+    image: wordpress
     ports:
     - containerPort: 8080
     env:
@@ -164,6 +170,110 @@ spec:
 	}
 }
 
+func TestGeneratePatchesWithConfigJSON(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+    contrast-agent-injector/config: CONTRAST__SERVER__ENVIRONMENT=qa, CONTRAST__SERVER__NAME=webgoat-k8s
+    contrast-agent-injector/config-json: '{"CONTRAST__APPLICATION__TAGS": "team-a,payments", "CONTRAST__SERVER__NAME": "webgoat-json"}'
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+    env:
+      - name: EXAMPLE_VAR
+        value: test
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+
+	envVars := map[string][]string{}
+	for _, patch := range patches {
+		if patch.Path == "/spec/containers/0/env/-" {
+			envVar := patch.Value.(corev1.EnvVar)
+			envVars[envVar.Name] = append(envVars[envVar.Name], envVar.Value)
+		}
+	}
+	assert.Equal(t, []string{"qa"}, envVars["CONTRAST__SERVER__ENVIRONMENT"])
+	assert.Equal(t, []string{"team-a,payments"}, envVars["CONTRAST__APPLICATION__TAGS"])
+	// config-json is applied after config and replaces the env vars both set
+	assert.Equal(t, []string{"webgoat-json"}, envVars["CONTRAST__SERVER__NAME"])
+}
+
+func TestGeneratePatchesContainerConfig(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+    contrast-agent-injector/config: CONTRAST__SERVER__ENVIRONMENT=qa, CONTRAST__SERVER__NAME=pod
+    contrast-agent-injector/config.webgoat: CONTRAST__SERVER__NAME=webgoat-k8s
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+    env:
+      - name: EXAMPLE_VAR
+        value: test
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+
+	// The per container config replaces the value of the Pod's config, the container gets every env var once
+	envVars := map[string][]string{}
+	for _, patch := range patches {
+		if patch.Path == "/spec/containers/0/env/-" {
+			envVar := patch.Value.(corev1.EnvVar)
+			envVars[envVar.Name] = append(envVars[envVar.Name], envVar.Value)
+		}
+	}
+	assert.Equal(t, []string{"qa"}, envVars["CONTRAST__SERVER__ENVIRONMENT"])
+	assert.Equal(t, []string{"webgoat-k8s"}, envVars["CONTRAST__SERVER__NAME"])
+	for name, values := range envVars {
+		assert.Len(t, values, 1, name)
+	}
+}
+
 func TestGeneratePatchesDuplicates(t *testing.T) {
 	podYaml := `
 apiVersion: v1
@@ -233,3 +343,1125 @@ spec:
 
 	assert.Equal(t, 8, len(patches))
 }
+
+func TestGeneratePatchesDotnetCore(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: eshop-pod
+  labels:
+    app: eshop
+  annotations:
+    contrast-agent-injector/language: dotnet-core
+    contrast-agent-injector/version: 2.1.12
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: eshop
+    image: eshop/web
+    ports:
+    - containerPort: 8080
+    env:
+      - name: EXAMPLE_VAR
+        value: test
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	assert.Equal(t, 9, len(patches))
+
+	envVars := map[string]string{}
+	for _, patch := range patches {
+		if patch.Path == "/spec/containers/0/env/-" {
+			envVar := patch.Value.(corev1.EnvVar)
+			envVars[envVar.Name] = envVar.Value
+		}
+	}
+	assert.Equal(t, "1", envVars["CORECLR_ENABLE_PROFILING"])
+	assert.Equal(t, "{8B2CE134-0948-48CA-A4B2-80DDAD9F5791}", envVars["CORECLR_PROFILER"])
+	assert.Contains(t, envVars["CORECLR_PROFILER_PATH_64"], "/opt/contrast/dotnet-core/")
+	assert.Equal(t, "/opt/contrast/contrast_security.yaml", envVars["CONTRAST_CONFIG_PATH"])
+}
+
+func TestGeneratePatchesNode(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: juice-shop-pod
+  labels:
+    app: juice-shop
+  annotations:
+    contrast-agent-injector/language: node
+    contrast-agent-injector/version: 4.24.0
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: juice-shop
+    image: bkimminich/juice-shop
+    ports:
+    - containerPort: 3000
+    env:
+      - name: NODE_OPTIONS
+        value: --max-old-space-size=512
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	assert.Equal(t, 7, len(patches))
+
+	var nodeOptionsPatch *patchOperation
+	for i, patch := range patches {
+		if patch.Path == "/spec/containers/0/env/0" {
+			nodeOptionsPatch = &patches[i]
+		}
+	}
+	if assert.NotNil(t, nodeOptionsPatch) {
+		assert.Equal(t, "replace", nodeOptionsPatch.Op)
+		assert.Equal(t, corev1.EnvVar{
+			Name:  "NODE_OPTIONS",
+			Value: "--max-old-space-size=512 --require /opt/contrast/node/node_modules/@contrast/agent",
+		}, nodeOptionsPatch.Value)
+	}
+}
+
+func TestGeneratePatchesNodeModule(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: juice-shop-pod
+  labels:
+    app: juice-shop
+  annotations:
+    contrast-agent-injector/language: node
+    contrast-agent-injector/version: latest
+    contrast-agent-injector/node-module-type: module
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: juice-shop
+    image: bkimminich/juice-shop
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+
+	for _, patch := range patches {
+		if patch.Path == "/spec/containers/0/env" {
+			envVars := patch.Value.([]corev1.EnvVar)
+			assert.Equal(t, "NODE_OPTIONS", envVars[0].Name)
+			assert.Contains(t, envVars[0].Value, "--import ")
+		}
+	}
+}
+
+func TestGeneratePatchesPython(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: flask-pod
+  labels:
+    app: flask
+  annotations:
+    contrast-agent-injector/language: python
+    contrast-agent-injector/version: 5.3.0
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: flask
+    image: flask
+    command: ["gunicorn", "app:app"]
+    ports:
+    - containerPort: 8080
+    env:
+      - name: PYTHONPATH
+        value: /app
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	assert.Equal(t, 7, len(patches))
+
+	for _, patch := range patches {
+		switch patch.Path {
+		case "/spec/initContainers":
+			initContainer := patch.Value.([]corev1.Container)[0]
+			assert.Equal(t, "flask", initContainer.Image)
+			assert.Contains(t, initContainer.Env, corev1.EnvVar{Name: "CONTRAST_AGENT_VERSION", Value: "5.3.0"})
+			assert.Contains(t, initContainer.Env, corev1.EnvVar{Name: "CONTRAST_AGENT_ARTIFACT", Value: "contrast-agent"})
+		case "/spec/containers/0/env/0":
+			assert.Equal(t, corev1.EnvVar{
+				Name:  "PYTHONPATH",
+				Value: "/opt/contrast/python/contrast/loader:/app:/opt/contrast/python",
+			}, patch.Value)
+		}
+	}
+}
+
+func TestGeneratePatchesRuby(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: rails-pod
+  labels:
+    app: rails
+  annotations:
+    contrast-agent-injector/language: ruby
+    contrast-agent-injector/version: 5.0.0
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: rails
+    image: rails-app
+    ports:
+    - containerPort: 3000
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	assert.Equal(t, 7, len(patches))
+
+	for _, patch := range patches {
+		switch patch.Path {
+		case "/spec/initContainers":
+			initContainer := patch.Value.([]corev1.Container)[0]
+			assert.Equal(t, "rails-app", initContainer.Image)
+			assert.Contains(t, initContainer.Args[0], `gem install "$CONTRAST_AGENT_ARTIFACT" "$@"`)
+			assert.Contains(t, initContainer.Env, corev1.EnvVar{Name: "CONTRAST_AGENT_VERSION", Value: "5.0.0"})
+		case "/spec/containers/0/env":
+			envVars := patch.Value.([]corev1.EnvVar)
+			assert.Equal(t, corev1.EnvVar{
+				Name:  "RUBYOPT",
+				Value: "-r/opt/contrast/ruby/contrast_loader.rb",
+			}, envVars[0])
+		}
+	}
+}
+
+func TestGeneratePatchesReinjection(t *testing.T) {
+	tt := []struct {
+		language string
+		image    string
+		envVar   corev1.EnvVar
+	}{
+		{
+			language: "node",
+			image:    "bkimminich/juice-shop",
+			envVar: corev1.EnvVar{
+				Name:  "NODE_OPTIONS",
+				Value: "--max-old-space-size=512 --require /opt/contrast/node/node_modules/@contrast/agent",
+			},
+		},
+		{
+			language: "ruby",
+			image:    "rails-app",
+			envVar: corev1.EnvVar{
+				Name:  "RUBYOPT",
+				Value: "-W0 -r/opt/contrast/ruby/contrast_loader.rb",
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.language, func(t *testing.T) {
+			// A Pod spec copied from an injected Pod already loads the agent
+			podYaml := fmt.Sprintf(`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: app-pod
+  annotations:
+    contrast-agent-injector/language: %v
+    contrast-agent-injector/version: latest
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: app
+    image: %v
+    env:
+      - name: %v
+        value: %v
+`, tc.language, tc.image, tc.envVar.Name, tc.envVar.Value)
+			scheme := runtime.NewScheme()
+			codecFactory := serializer.NewCodecFactory(scheme)
+			deserializer := codecFactory.UniversalDeserializer()
+
+			podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+			assert.NoError(t, err)
+			pod := podObject.(*corev1.Pod)
+
+			agentPatch := AgentPatch{
+				pod:        *pod,
+				secretName: "test",
+			}
+
+			patches, err := agentPatch.GenerateAgentPatches()
+			assert.NoError(t, err)
+
+			var envVarPatch *patchOperation
+			for i, patch := range patches {
+				if patch.Path == "/spec/containers/0/env/0" {
+					envVarPatch = &patches[i]
+				}
+			}
+			if assert.NotNil(t, envVarPatch) {
+				assert.Equal(t, tc.envVar, envVarPatch.Value)
+			}
+		})
+	}
+}
+
+func TestGeneratePatchesDetectLanguage(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: auto
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+    command: ["java", "-jar", "/home/webgoat/webgoat.jar"]
+    ports:
+    - containerPort: 8080
+    env:
+      - name: EXAMPLE_VAR
+        value: test
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(patches))
+
+	delete(agentPatch.pod.Annotations, injectorLanguageAnnotation)
+	patches, err = agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(patches))
+}
+
+func TestGeneratePatchesTargetContainer(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/container: webgoat
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: istio-proxy
+    image: istio/proxyv2
+    env:
+      - name: ISTIO_META_APP_CONTAINERS
+        value: webgoat
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+    ports:
+    - containerPort: 8080
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(patches))
+
+	for _, patch := range patches {
+		assert.False(t, strings.HasPrefix(patch.Path, "/spec/containers/0"), "unexpected patch path %v", patch.Path)
+		if patch.Path == "/spec/containers/1/env/-" && patch.Value.(corev1.EnvVar).Name == "CONTRAST__AGENT__JAVA__STANDALONE_APP_NAME" {
+			assert.Equal(t, "webgoat", patch.Value.(corev1.EnvVar).Value)
+		}
+	}
+
+	agentPatch.pod.Annotations[injectorContainerAnnotation] = "missing"
+	_, err = agentPatch.GenerateAgentPatches()
+	assert.EqualError(t, err, "container missing set in contrast-agent-injector/container not found in the Pod")
+}
+
+func TestGeneratePatchesMultipleContainers(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: orders-pod
+  labels:
+    app: orders
+  annotations:
+    contrast-agent-injector/inject-all: "true"
+    contrast-agent-injector/exclude-containers: metrics
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/language.bff: node
+    contrast-agent-injector/version.bff: 4.24.0
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: istio-proxy
+    image: istio/proxyv2
+  - name: orders
+    image: eclipse-temurin:17-jre
+  - name: worker
+    image: registry.example.com/orders-worker
+    command: ["java", "-jar", "/app/worker.jar"]
+  - name: bff
+    image: registry.example.com/orders-bff
+  - name: metrics
+    image: registry.example.com/metrics
+    command: ["java", "-jar", "/app/metrics.jar"]
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+
+	var volumes []corev1.Volume
+	var initContainers []corev1.Container
+	appNames := map[string]string{}
+	volumeMountSubPaths := map[string]string{}
+	for _, patch := range patches {
+		switch value := patch.Value.(type) {
+		case []corev1.Volume:
+			volumes = append(volumes, value...)
+		case corev1.Volume:
+			volumes = append(volumes, value)
+		case []corev1.Container:
+			initContainers = append(initContainers, value...)
+		case corev1.Container:
+			initContainers = append(initContainers, value)
+		case []corev1.VolumeMount:
+			volumeMountSubPaths[patch.Path] = value[0].SubPath
+		case []corev1.EnvVar:
+			for _, envVar := range value {
+				if envVar.Name == "CONTRAST__AGENT__JAVA__STANDALONE_APP_NAME" {
+					appNames[patch.Path] = envVar.Value
+				}
+			}
+		case corev1.EnvVar:
+			if value.Name == "CONTRAST__AGENT__JAVA__STANDALONE_APP_NAME" {
+				appNames[patch.Path] = value.Value
+			}
+		}
+		assert.False(t, strings.HasPrefix(patch.Path, "/spec/containers/0/"), "istio-proxy should not be injected")
+		assert.False(t, strings.HasPrefix(patch.Path, "/spec/containers/4/"), "metrics should not be injected")
+	}
+
+	assert.Equal(t, 2, len(volumes))
+	if assert.Equal(t, 2, len(initContainers)) {
+		assert.Equal(t, "contrast-agent-injector", initContainers[0].Name)
+		assert.Equal(t, DefaultInjectorImage, initContainers[0].Image)
+		assert.Equal(t, "contrast-agent-injector-2", initContainers[1].Name)
+		assert.Equal(t, "node:16-alpine", initContainers[1].Image)
+		assert.Equal(t, "contrast-agent-injector-2", initContainers[1].VolumeMounts[0].SubPath)
+	}
+	assert.Equal(t, map[string]string{
+		"/spec/containers/1/env/-": "orders",
+		"/spec/containers/2/env/-": "worker",
+	}, appNames)
+	assert.Equal(t, map[string]string{
+		"/spec/containers/1/volumeMounts": "contrast-agent-injector",
+		"/spec/containers/2/volumeMounts": "contrast-agent-injector",
+		"/spec/containers/3/volumeMounts": "contrast-agent-injector-2",
+	}, volumeMountSubPaths)
+}
+
+func TestGeneratePatchesImageDelivery(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:          *pod,
+		secretName:   "test",
+		deliveryMode: DeliveryImage,
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+
+	for _, patch := range patches {
+		if patch.Path == "/spec/initContainers" {
+			initContainer := patch.Value.([]corev1.Container)[0]
+			assert.Equal(t, "contrast/agent-java:3.8.7.21531", initContainer.Image)
+			assert.Equal(t, []string{"cp", "/contrast/contrast-agent.jar", "/opt/contrast/contrast.jar"}, initContainer.Command)
+		}
+	}
+
+	// The annotation takes precedence over the delivery mode of the injector
+	agentPatch.pod.Annotations[injectorDeliveryAnnotation] = DeliveryDownload
+	patches, err = agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	for _, patch := range patches {
+		if patch.Path == "/spec/initContainers" {
+			assert.Equal(t, DefaultInjectorImage, patch.Value.([]corev1.Container)[0].Image)
+		}
+	}
+
+	agentPatch.pod.Annotations[injectorDeliveryAnnotation] = DeliveryImage
+	agentPatch.pod.Annotations[injectorLanguageAnnotation] = "python"
+	_, err = agentPatch.GenerateAgentPatches()
+	assert.Error(t, err)
+}
+
+func TestGeneratePatchesVerification(t *testing.T) {
+	agentsConfig := `
+verification:
+  java:
+    policy: uninstrumented
+    checksums:
+      3.8.7.21531: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+`
+	path := filepath.Join(t.TempDir(), "agents.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(agentsConfig), 0600))
+	agents, err := LoadAgentRegistry(path)
+	assert.NoError(t, err)
+
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+		agents:     agents,
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+
+	for _, patch := range patches {
+		if patch.Path == "/spec/initContainers" {
+			initContainer := patch.Value.([]corev1.Container)[0]
+			assert.Equal(t, []corev1.EnvVar{
+				{Name: "CONTRAST_AGENT_VERSION", Value: "3.8.7.21531"},
+				{Name: "CONTRAST_AGENT_ARTIFACT", Value: "contrast-agent"},
+				{Name: "CONTRAST_AGENT_ARTIFACT_URL", Value: initContainer.Args[1]},
+				{Name: "CONTRAST_AGENT_SHA256", Value: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+				{Name: "CONTRAST_VERIFICATION_POLICY", Value: "uninstrumented"},
+			}, initContainer.Env)
+		}
+	}
+}
+
+func TestGeneratePatchesResolveVersion(t *testing.T) {
+	requests := 0
+	available := true
+	repository := newTestMavenRepository(t, &requests, &available)
+
+	agentsConfig := fmt.Sprintf(`
+artifactMirrors:
+  java:
+    url: %v/{{ .Artifact }}-{{ .Version }}.jar
+    metadataUrl: %v/{{ replace .Group "." "/" }}/{{ .Artifact }}/maven-metadata.xml
+`, repository.URL, repository.URL)
+	path := filepath.Join(t.TempDir(), "agents.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(agentsConfig), 0600))
+	agents, err := LoadAgentRegistry(path)
+	assert.NoError(t, err)
+
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.x
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+		agents:     agents,
+		resolver:   NewVersionResolver(http.DefaultClient, time.Minute),
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	assert.Equal(t, 9, len(patches))
+
+	for _, patch := range patches {
+		if patch.Path == "/spec/initContainers" {
+			initContainer := patch.Value.([]corev1.Container)[0]
+			assert.Equal(t, repository.URL+"/contrast-agent-3.10.2.27000.jar", initContainer.Args[1])
+		}
+	}
+	assert.Equal(t, patchOperation{
+		Op:    "add",
+		Path:  "/metadata/annotations/contrast-agent-injector~1resolved-version.webgoat",
+		Value: "3.10.2.27000",
+	}, patches[len(patches)-1])
+}
+
+func TestGeneratePatchesArtifactCache(t *testing.T) {
+	agentsConfig := `
+artifactMirrors:
+  java:
+    url: https://nexus.example.com/{{ .Artifact }}-{{ .Version }}.jar
+    credentialsSecret: nexus-credentials
+`
+	path := filepath.Join(t.TempDir(), "agents.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(agentsConfig), 0600))
+	agents, err := LoadAgentRegistry(path)
+	assert.NoError(t, err)
+
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: orders-pod
+  labels:
+    app: orders
+  annotations:
+    contrast-agent-injector/container: orders,bff
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/language.orders: java
+    contrast-agent-injector/language.bff: node
+    contrast-agent-injector/version.bff: 4.24.0
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: orders
+    image: eclipse-temurin:17-jre
+  - name: bff
+    image: node:16
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:              *pod,
+		secretName:       "test",
+		agents:           agents,
+		artifactCacheURL: "http://contrast-agent-injector.contrast.svc:8080/",
+		injectorImage:    "registry.example.com/contrast-agent-injector:0.2.0",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+
+	var initContainers []corev1.Container
+	for _, patch := range patches {
+		switch patch.Path {
+		case "/spec/initContainers":
+			initContainers = append(initContainers, patch.Value.([]corev1.Container)...)
+		case "/spec/initContainers/-":
+			initContainers = append(initContainers, patch.Value.(corev1.Container))
+		}
+	}
+	if assert.Equal(t, 2, len(initContainers)) {
+		// The cache downloads the agent from the mirror, the init container doesn't get the credentials
+		assert.Equal(t, "registry.example.com/contrast-agent-injector:0.2.0", initContainers[0].Image)
+		assert.Equal(t, []string{"/contrast-agent-injector", "fetch-agent"}, initContainers[0].Command)
+		assert.Equal(t, "http://contrast-agent-injector.contrast.svc:8080/agents/java/3.8.7.21531", initContainers[0].Args[1])
+		assert.Equal(t, []corev1.EnvVar{
+			{Name: "CONTRAST_AGENT_VERSION", Value: "3.8.7.21531"},
+			{Name: "CONTRAST_AGENT_ARTIFACT", Value: "contrast-agent"},
+			{Name: "CONTRAST_AGENT_ARTIFACT_URL", Value: "http://contrast-agent-injector.contrast.svc:8080/agents/java/3.8.7.21531"},
+		}, initContainers[0].Env)
+		// Agents installed from a package registry aren't cached
+		assert.Contains(t, initContainers[1].Env, corev1.EnvVar{Name: "CONTRAST_AGENT_ARTIFACT_URL", Value: "https://registry.npmjs.org/"})
+	}
+}
+
+func TestGeneratePatchesFailurePolicy(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	initContainerEnv := func(agentPatch AgentPatch) []corev1.EnvVar {
+		patches, err := agentPatch.GenerateAgentPatches()
+		assert.NoError(t, err)
+		for _, patch := range patches {
+			if patch.Path != "/spec/initContainers" {
+				continue
+			}
+			var env []corev1.EnvVar
+			for _, envVar := range patch.Value.([]corev1.Container)[0].Env {
+				if envVar.Name == "CONTRAST_FAILURE_POLICY" {
+					env = append(env, envVar)
+				}
+			}
+			return env
+		}
+		return nil
+	}
+	openEnv := []corev1.EnvVar{{Name: "CONTRAST_FAILURE_POLICY", Value: FailurePolicyOpen}}
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+	assert.Empty(t, initContainerEnv(agentPatch))
+
+	// The failure policy of the injector is the default
+	agentPatch.failurePolicy = FailurePolicyOpen
+	assert.Equal(t, openEnv, initContainerEnv(agentPatch))
+
+	// The annotation takes precedence over the failure policy of the injector
+	agentPatch.pod.Annotations[injectorFailurePolicyAnnotation] = "closed"
+	assert.Empty(t, initContainerEnv(agentPatch))
+
+	agentPatch.failurePolicy = FailurePolicyClosed
+	agentPatch.pod.Annotations[containerAnnotation(injectorFailurePolicyAnnotation, "webgoat")] = "Open"
+	assert.Equal(t, openEnv, initContainerEnv(agentPatch))
+
+	agentPatch.pod.Annotations[injectorFailurePolicyAnnotation] = "ignore"
+	delete(agentPatch.pod.Annotations, containerAnnotation(injectorFailurePolicyAnnotation, "webgoat"))
+	_, err = agentPatch.GenerateAgentPatches()
+	assert.EqualError(t, err, "contrast-agent-injector/failure-policy must be closed or open")
+}
+
+func TestGeneratePatchesFailurePolicyPerContainer(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: orders-pod
+  labels:
+    app: orders
+  annotations:
+    contrast-agent-injector/container: orders,worker
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/failure-policy.worker: open
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: orders
+    image: eclipse-temurin:17-jre
+  - name: worker
+    image: eclipse-temurin:17-jre
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+
+	var initContainers []corev1.Container
+	volumeMountSubPaths := map[string]string{}
+	for _, patch := range patches {
+		switch value := patch.Value.(type) {
+		case []corev1.Container:
+			initContainers = append(initContainers, value...)
+		case corev1.Container:
+			initContainers = append(initContainers, value)
+		case []corev1.VolumeMount:
+			volumeMountSubPaths[patch.Path] = value[0].SubPath
+		}
+	}
+
+	// The containers use the same agent, but can't share an init container with a different failure policy
+	if assert.Equal(t, 2, len(initContainers)) {
+		assert.Equal(t, "contrast-agent-injector", initContainers[0].Name)
+		assert.NotContains(t, initContainers[0].Env, corev1.EnvVar{Name: "CONTRAST_FAILURE_POLICY", Value: FailurePolicyOpen})
+		assert.Equal(t, "contrast-agent-injector-2", initContainers[1].Name)
+		assert.Contains(t, initContainers[1].Env, corev1.EnvVar{Name: "CONTRAST_FAILURE_POLICY", Value: FailurePolicyOpen})
+	}
+	assert.Equal(t, map[string]string{
+		"/spec/containers/0/volumeMounts": "contrast-agent-injector",
+		"/spec/containers/1/volumeMounts": "contrast-agent-injector-2",
+	}, volumeMountSubPaths)
+}
+
+func TestGeneratePatchesInitContainerResources(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+    contrast-agent-injector/init-memory-limit: 1Gi
+spec:
+  securityContext:
+    runAsUser: 1000
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	var initContainer corev1.Container
+	for _, patch := range patches {
+		if patch.Path == "/spec/initContainers" {
+			initContainer = patch.Value.([]corev1.Container)[0]
+		}
+	}
+	assert.Equal(t, "100m", initContainer.Resources.Requests.Cpu().String())
+	assert.Equal(t, "1Gi", initContainer.Resources.Limits.Memory().String())
+	assert.Equal(t, int64(1000), *initContainer.SecurityContext.RunAsUser)
+	assert.True(t, *initContainer.SecurityContext.ReadOnlyRootFilesystem)
+	assert.Contains(t, initContainer.VolumeMounts, initContainerTmpVolumeMount())
+
+	// A limit below the default request lowers the request
+	agentPatch.pod.Annotations[injectorMemoryLimitAnnotation] = "64Mi"
+	patches, err = agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	for _, patch := range patches {
+		if patch.Path == "/spec/initContainers" {
+			initContainer = patch.Value.([]corev1.Container)[0]
+		}
+	}
+	assert.Equal(t, "64Mi", initContainer.Resources.Requests.Memory().String())
+	assert.Equal(t, "64Mi", initContainer.Resources.Limits.Memory().String())
+
+	agentPatch.pod.Annotations[injectorMemoryRequestAnnotation] = "128Mi"
+	_, err = agentPatch.GenerateAgentPatches()
+	assert.EqualError(t, err, "init container memory request 128Mi exceeds the limit 64Mi")
+}
+
+func TestGeneratePatchesVersionPolicy(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.9.1.24000
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agents := DefaultAgentRegistry()
+	java := agents["java"]
+	java.VersionPolicy = &VersionPolicy{
+		Denied:         []string{"3.9.1.24000"},
+		DefaultVersion: "3.8.7.21531",
+	}
+	agents["java"] = java
+
+	var warnings []string
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+		agents:     agents,
+		warnings:   &warnings,
+	}
+
+	_, err = agentPatch.GenerateAgentPatches()
+	assert.EqualError(t, err, "Skipping mutation: java agent version 3.9.1.24000 of container webgoat is denied")
+
+	java.VersionPolicy.Action = VersionPolicyRewrite
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"java agent version 3.9.1.24000 of container webgoat is denied, injecting the default version 3.8.7.21531 instead"}, warnings)
+
+	// The injected version is recorded on the Pod
+	last := patches[len(patches)-1]
+	assert.Equal(t, "/metadata/annotations/contrast-agent-injector~1resolved-version.webgoat", last.Path)
+	assert.Equal(t, "3.8.7.21531", last.Value)
+	for _, patch := range patches {
+		if patch.Path == "/spec/initContainers" {
+			assert.Contains(t, patch.Value.([]corev1.Container)[0].Args[1], "3.8.7.21531")
+		}
+	}
+}
+
+func TestGeneratePatchesConfigYAML(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+    contrast-agent-injector/config-yaml: |
+      agent:
+        logger:
+          level: DEBUG
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+	scheme := runtime.NewScheme()
+	codecFactory := serializer.NewCodecFactory(scheme)
+	deserializer := codecFactory.UniversalDeserializer()
+
+	podObject, _, err := deserializer.Decode([]byte(podYaml), nil, &corev1.Pod{})
+	assert.NoError(t, err)
+	pod := podObject.(*corev1.Pod)
+
+	agentPatch := AgentPatch{
+		pod:        *pod,
+		secretName: "test",
+	}
+
+	patches, err := agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+	var initContainers []corev1.Container
+	var volumeMounts []corev1.VolumeMount
+	var envVars []corev1.EnvVar
+	for _, patch := range patches {
+		switch patch.Path {
+		case "/spec/initContainers":
+			initContainers = patch.Value.([]corev1.Container)
+		case "/spec/initContainers/-":
+			initContainers = append(initContainers, patch.Value.(corev1.Container))
+		case "/spec/containers/0/volumeMounts":
+			volumeMounts = patch.Value.([]corev1.VolumeMount)
+		case "/spec/containers/0/volumeMounts/-":
+			volumeMounts = append(volumeMounts, patch.Value.(corev1.VolumeMount))
+		case "/spec/containers/0/env":
+			envVars = patch.Value.([]corev1.EnvVar)
+		case "/spec/containers/0/env/-":
+			envVars = append(envVars, patch.Value.(corev1.EnvVar))
+		}
+	}
+
+	assert.Len(t, initContainers, 2)
+	configContainer := initContainers[1]
+	assert.Equal(t, configMergeContainerName, configContainer.Name)
+	assert.Equal(t, []string{"/contrast-agent-injector", "merge-config"}, configContainer.Command)
+	assert.Contains(t, configContainer.Env, corev1.EnvVar{Name: "CONTRAST_CONFIG_OVERRIDES", Value: "agent:\n  logger:\n    level: DEBUG\n"})
+	assert.True(t, *configContainer.SecurityContext.ReadOnlyRootFilesystem)
+	assert.NotNil(t, configContainer.Resources.Limits.Memory())
+
+	assert.Contains(t, volumeMounts, mergedConfigVolumeMount())
+	var configPaths []string
+	for _, envVar := range envVars {
+		if envVar.Name == "CONTRAST_CONFIG_PATH" {
+			configPaths = append(configPaths, envVar.Value)
+		}
+	}
+	assert.Equal(t, []string{"/opt/contrast-config/contrast_security.yaml"}, configPaths)
+
+	agentPatch.pod.Annotations[injectorConfigYAMLAnnotation] = "api:\n  api_key: other\n"
+	_, err = agentPatch.GenerateAgentPatches()
+	assert.EqualError(t, err, "contrast-agent-injector/config-yaml can't override api, the api settings of the contrast_security.yaml secret are protected")
+
+	agentPatch.allowConfigAPIOverrides = true
+	_, err = agentPatch.GenerateAgentPatches()
+	assert.NoError(t, err)
+}
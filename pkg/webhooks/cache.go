@@ -0,0 +1,279 @@
+package webhooks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// artifactCachePath is the path the artifact cache serves agents on, followed by <language>/<version>
+const artifactCachePath = `/agents/`
+
+var cacheVersionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ArtifactCache serves agent artifacts from a directory, such as a PersistentVolume, so every Pod downloads the
+// agent from the injector instead of the internet. Artifacts missing from the directory are downloaded from the
+// upstream artifact URL once and verified before they are stored, unless the cache is air gapped.
+type ArtifactCache struct {
+	directory string
+	agents    AgentRegistry
+	verifier  *ArtifactVerifier
+	client    *http.Client
+	airGapped bool
+	mutex     sync.Mutex
+	downloads map[string]*sync.Mutex
+}
+
+// NewArtifactCache returns an ArtifactCache storing artifacts in directory. An air gapped cache never downloads
+// artifacts, it only serves the artifacts already in directory.
+func NewArtifactCache(directory string, agents AgentRegistry, verifier *ArtifactVerifier, client *http.Client, airGapped bool) *ArtifactCache {
+	if agents == nil {
+		agents = defaultAgentRegistry
+	}
+	if verifier == nil {
+		verifier = defaultArtifactVerifier
+	}
+	cache := &ArtifactCache{
+		directory: directory,
+		agents:    agents,
+		verifier:  verifier,
+		client:    client,
+		airGapped: airGapped,
+		downloads: map[string]*sync.Mutex{},
+	}
+	if languages := cache.unverifiedLanguages(); len(languages) != 0 && !airGapped {
+		log.Warnf("The artifact cache stores and serves the %v agents without verifying them, add a verification section for them to --agentsConfig",
+			strings.Join(languages, ", "))
+	}
+	return cache
+}
+
+// ValidateArtifactCache returns an error when the cache would download an agent from a mirror that requires
+// credentials. The credentials are a Secret in the namespace of each Pod, which the cache can't read, so the download
+// would fail. An air gapped cache only serves the agents it was seeded with and never downloads them.
+func ValidateArtifactCache(agents AgentRegistry, airGapped bool) error {
+	if agents == nil {
+		agents = defaultAgentRegistry
+	}
+	if airGapped {
+		return nil
+	}
+	languages := make([]string, 0, len(agents))
+	for language := range agents {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	for _, language := range languages {
+		definition := agents[language]
+		if cacheable(definition) && len(definition.Artifact.CredentialsSecret) != 0 {
+			return fmt.Errorf("the artifact cache can't download the %v agent from a mirror with the credentials secret %v, remove the credentials or seed an air gapped cache", language, definition.Artifact.CredentialsSecret)
+		}
+	}
+	return nil
+}
+
+// unverifiedLanguages returns the languages whose agents the cache downloads without verifying them
+func (cache *ArtifactCache) unverifiedLanguages() []string {
+	var languages []string
+	for language, definition := range cache.agents {
+		if cacheable(definition) && definition.Artifact.Verification == nil {
+			languages = append(languages, language)
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// cacheable returns true if the agent is downloaded as a single file the cache can store, agents installed from a
+// package registry are always installed from the registry
+func cacheable(definition AgentDefinition) bool {
+	return definition.Artifact != nil && !definition.Artifact.Registry
+}
+
+// cacheArtifactURL returns the URL template of the agent for language in the cache served at cacheURL
+func cacheArtifactURL(cacheURL, language string) string {
+	return fmt.Sprintf("%v%v%v/{{ .Version }}", strings.TrimSuffix(cacheURL, "/"), artifactCachePath, strings.ToLower(language))
+}
+
+// Seed copies the artifacts in directory, laid out as <language>/<version>, into the cache
+func (cache *ArtifactCache) Seed(directory string) error {
+	languages, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return fmt.Errorf("could not read seed directory: %v", err)
+	}
+	for _, language := range languages {
+		if !language.IsDir() {
+			continue
+		}
+		versions, err := ioutil.ReadDir(filepath.Join(directory, language.Name()))
+		if err != nil {
+			return fmt.Errorf("could not read seed directory: %v", err)
+		}
+		for _, version := range versions {
+			if version.IsDir() {
+				continue
+			}
+			if err := cache.seedArtifact(filepath.Join(directory, language.Name(), version.Name()), language.Name(), version.Name()); err != nil {
+				return err
+			}
+			log.Infof("Seeded %v agent version %v", language.Name(), version.Name())
+		}
+	}
+	return nil
+}
+
+func (cache *ArtifactCache) seedArtifact(path, language, version string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not seed %v: %v", path, err)
+	}
+	defer source.Close()
+	if err := cache.store(source, language, version, ""); err != nil {
+		return fmt.Errorf("could not seed %v: %v", path, err)
+	}
+	return nil
+}
+
+// ServeHTTP serves /agents/<language>/<version>
+func (cache *ArtifactCache) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(request.URL.Path, artifactCachePath), "/")
+	if len(parts) != 2 {
+		http.NotFound(response, request)
+		return
+	}
+	language, version := strings.ToLower(parts[0]), parts[1]
+	definition, ok := cache.agents[language]
+	if !ok || !cacheable(definition) || !cacheVersionPattern.MatchString(version) || isVersionRange(version) {
+		http.NotFound(response, request)
+		return
+	}
+
+	path, err := cache.artifact(definition, language, version)
+	if err != nil {
+		log.Errorf("Could not cache %v agent version %v: %v", language, version, err)
+		http.Error(response, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if len(path) == 0 {
+		http.NotFound(response, request)
+		return
+	}
+
+	http.ServeFile(response, request, path)
+}
+
+// artifact returns the path of the cached artifact, downloading it from upstream if it isn't cached yet.
+// An empty path is returned when an air gapped cache doesn't contain the artifact.
+func (cache *ArtifactCache) artifact(definition AgentDefinition, language, version string) (string, error) {
+	path := filepath.Join(cache.directory, language, version)
+
+	cache.mutex.Lock()
+	download, ok := cache.downloads[path]
+	if !ok {
+		download = &sync.Mutex{}
+		cache.downloads[path] = download
+	}
+	cache.mutex.Unlock()
+
+	// Concurrent requests for the same artifact wait for a single download
+	download.Lock()
+	defer download.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if cache.airGapped {
+		return "", nil
+	}
+
+	artifact := *definition.Artifact
+	data := agentTemplateData{Version: version}
+	artifactURL, err := artifact.render(data)
+	if err != nil {
+		return "", err
+	}
+	var expectedChecksum string
+	if artifact.Verification != nil {
+		// The cache downloads outside of admissions and waits for the signature to be verified
+		expectedChecksum, err = cache.verifier.checksum(artifact, data, 0)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	log.Infof("Downloading %v agent version %v from %v", language, version, artifactURL)
+	upstream, err := cache.get(artifactURL)
+	if err != nil {
+		return "", err
+	}
+	defer upstream.Close()
+
+	if err := cache.store(upstream, language, version, expectedChecksum); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// store writes the artifact to the cache atomically, so a partially written or unverified artifact is never served.
+// The artifact isn't stored if it doesn't match expectedChecksum, when it is set.
+func (cache *ArtifactCache) store(artifact io.Reader, language, version, expectedChecksum string) error {
+	if !cacheVersionPattern.MatchString(language) || !cacheVersionPattern.MatchString(version) {
+		return fmt.Errorf("invalid artifact %v/%v", language, version)
+	}
+	directory := filepath.Join(cache.directory, strings.ToLower(language))
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(directory, "."+version+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(temp, io.TeeReader(artifact, hash)); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); len(expectedChecksum) != 0 && checksum != expectedChecksum {
+		return fmt.Errorf("%v agent version %v does not match the expected checksum %v", language, version, expectedChecksum)
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), filepath.Join(directory, version))
+}
+
+func (cache *ArtifactCache) get(url string) (io.ReadCloser, error) {
+	response, err := cache.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("unexpected status downloading %v: %v", url, response.Status)
+	}
+	return response.Body, nil
+}
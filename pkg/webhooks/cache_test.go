@@ -0,0 +1,149 @@
+package webhooks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactCache(t *testing.T) {
+	agent := []byte("contrast agent jar")
+	sum := sha256.Sum256(agent)
+	checksum := hex.EncodeToString(sum[:])
+
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requests++
+		switch request.URL.Path {
+		case "/contrast-agent-3.8.7.21531.jar", "/contrast-agent-3.8.8.21600.jar":
+			_, _ = response.Write(agent)
+		default:
+			http.NotFound(response, request)
+		}
+	}))
+	defer upstream.Close()
+
+	agents := DefaultAgentRegistry()
+	java := agents["java"]
+	java.Artifact = &ArtifactDefinition{
+		Group:    "com.contrastsecurity",
+		Artifact: "contrast-agent",
+		URL:      upstream.URL + "/{{ .Artifact }}-{{ .Version }}.jar",
+		Verification: &ArtifactVerification{
+			Checksums: map[string]string{
+				"3.8.7.21531": checksum,
+				"3.8.8.21600": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			},
+		},
+	}
+	agents["java"] = java
+
+	directory := t.TempDir()
+	cache := httptest.NewServer(NewArtifactCache(directory, agents, nil, http.DefaultClient, false))
+	defer cache.Close()
+
+	// The artifact is only downloaded from upstream once
+	for i := 0; i < 2; i++ {
+		response, err := http.Get(cache.URL + "/agents/java/3.8.7.21531")
+		assert.NoError(t, err)
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, agent, body)
+	}
+	assert.Equal(t, 1, requests)
+	assert.FileExists(t, filepath.Join(directory, "java", "3.8.7.21531"))
+
+	// Artifacts that don't match their checksum aren't cached
+	response, err := http.Get(cache.URL + "/agents/java/3.8.8.21600")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	assert.NoFileExists(t, filepath.Join(directory, "java", "3.8.8.21600"))
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "missing upstream", path: "/agents/java/1.0.0"},
+		{name: "unknown language", path: "/agents/php/1.0.0"},
+		{name: "registry artifact", path: "/agents/node/4.24.0"},
+		{name: "version range", path: "/agents/java/latest"},
+		{name: "hidden file", path: "/agents/java/.3.8.7.21531"},
+		{name: "traversal", path: "/agents/java/..%2f..%2fetc%2fpasswd"},
+		{name: "nested path", path: "/agents/java/3.8.7.21531/contrast.jar"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := http.Get(cache.URL + test.path)
+			assert.NoError(t, err)
+			response.Body.Close()
+			assert.NotEqual(t, http.StatusOK, response.StatusCode)
+		})
+	}
+}
+
+func TestArtifactCacheAirGapped(t *testing.T) {
+	seed := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(seed, "java"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(seed, "java", "3.8.7.21531"), []byte("contrast agent jar"), 0644))
+
+	artifactCache := NewArtifactCache(t.TempDir(), nil, nil, http.DefaultClient, true)
+	assert.NoError(t, artifactCache.Seed(seed))
+	cache := httptest.NewServer(artifactCache)
+	defer cache.Close()
+
+	response, err := http.Get(cache.URL + "/agents/java/3.8.7.21531")
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "contrast agent jar", string(body))
+
+	// Artifacts missing from an air gapped cache are never downloaded
+	response, err = http.Get(cache.URL + "/agents/java/3.8.8.21600")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	assert.Error(t, artifactCache.Seed(filepath.Join(seed, "missing")))
+}
+
+func TestArtifactCacheUnverifiedLanguages(t *testing.T) {
+	agents := DefaultAgentRegistry()
+	cache := NewArtifactCache(t.TempDir(), agents, nil, http.DefaultClient, false)
+	// Agents installed from a package registry aren't cached
+	assert.Equal(t, []string{"dotnet-core", "java"}, cache.unverifiedLanguages())
+
+	java := agents["java"]
+	artifact := *java.Artifact
+	artifact.Verification = &ArtifactVerification{Checksums: map[string]string{}}
+	java.Artifact = &artifact
+	agents["java"] = java
+	assert.Equal(t, []string{"dotnet-core"}, NewArtifactCache(t.TempDir(), agents, nil, http.DefaultClient, false).unverifiedLanguages())
+}
+
+func TestValidateArtifactCache(t *testing.T) {
+	agents := DefaultAgentRegistry()
+	assert.NoError(t, ValidateArtifactCache(agents, false))
+
+	java := agents["java"]
+	artifact := *java.Artifact
+	artifact.URL = "https://artifactory.example.com/maven/{{ .Version }}.jar"
+	artifact.CredentialsSecret = "artifactory-credentials"
+	java.Artifact = &artifact
+	agents["java"] = java
+	assert.EqualError(t, ValidateArtifactCache(agents, false), "the artifact cache can't download the java agent from a mirror with the credentials secret artifactory-credentials, remove the credentials or seed an air gapped cache")
+
+	// An air gapped cache never downloads from the mirror
+	assert.NoError(t, ValidateArtifactCache(agents, true))
+}
@@ -0,0 +1,359 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cbuto/contrast-agent-injector/pkg/mergeconfig"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// injectorConfigJSONAnnotation configures the agent with a JSON or YAML map of env var names to values, or a list
+	// of env vars with a name and a value
+	injectorConfigJSONAnnotation = `contrast-agent-injector/config-json`
+	// injectorConfigYAMLAnnotation is a YAML fragment of contrast_security.yaml, merged over the config of the secret
+	// by an init container when the Pod starts
+	injectorConfigYAMLAnnotation = `contrast-agent-injector/config-yaml`
+	// configMergeContainerName is the name of the init container merging the config-yaml and config-from overrides
+	configMergeContainerName = `contrast-agent-injector-config`
+	// mergedConfigPath is the directory the merged contrast_security.yaml is mounted at
+	mergedConfigPath = `/opt/contrast-config`
+	// mergedConfigSubPath is the sub path of the agent volume the merged config is written to
+	mergedConfigSubPath = `.config`
+	// protectedConfigKey is the contrast_security.yaml section config-yaml can't override, it holds the API keys
+	protectedConfigKey = `api`
+)
+
+// configEscapes are the characters escaped with a backslash in double quoted config annotation values
+var configEscapes = map[rune]rune{
+	'"':  '"',
+	'\'': '\'',
+	'\\': '\\',
+	',':  ',',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+}
+
+// configParser parses the comma separated NAME=value pairs of a config annotation. Values are unquoted and taken
+// literally, in double quotes with backslash escapes, or in single quotes taken literally, so they can contain commas.
+type configParser struct {
+	annotation string
+	runes      []rune
+	position   int
+}
+
+// errorf returns an error for the character at position, counting from 1
+func (parser *configParser) errorf(position int, format string, args ...interface{}) error {
+	return fmt.Errorf("%v is invalid at character %v: %v", parser.annotation, position+1, fmt.Sprintf(format, args...))
+}
+
+func (parser *configParser) done() bool {
+	return parser.position >= len(parser.runes)
+}
+
+func (parser *configParser) peek() rune {
+	return parser.runes[parser.position]
+}
+
+func (parser *configParser) skipSpaces() {
+	for !parser.done() && (parser.peek() == ' ' || parser.peek() == '\t' || parser.peek() == '\n' || parser.peek() == '\r') {
+		parser.position++
+	}
+}
+
+func (parser *configParser) parse() ([]corev1.EnvVar, error) {
+	var envVars []corev1.EnvVar
+	for {
+		parser.skipSpaces()
+		if parser.done() {
+			return envVars, nil
+		}
+		// Empty pairs are ignored
+		if parser.peek() == ',' {
+			parser.position++
+			continue
+		}
+
+		start := parser.position
+		for !parser.done() && parser.peek() != '=' && parser.peek() != ',' {
+			parser.position++
+		}
+		name := strings.TrimSpace(string(parser.runes[start:parser.position]))
+		if parser.done() || parser.peek() == ',' {
+			return nil, parser.errorf(parser.position, "expected = after %q", name)
+		}
+		if len(name) == 0 {
+			return nil, parser.errorf(start, "expected an env var name before =")
+		}
+		if errs := validation.IsEnvVarName(name); len(errs) != 0 {
+			return nil, parser.errorf(start, "%q is not a valid env var name", name)
+		}
+		parser.position++
+
+		parser.skipSpaces()
+		value, err := parser.value()
+		if err != nil {
+			return nil, err
+		}
+		envVars = append(envVars, corev1.EnvVar{Name: name, Value: value})
+
+		parser.skipSpaces()
+		if parser.done() {
+			return envVars, nil
+		}
+		if parser.peek() != ',' {
+			return nil, parser.errorf(parser.position, "expected , after the value of %v", name)
+		}
+		parser.position++
+	}
+}
+
+func (parser *configParser) value() (string, error) {
+	if parser.done() {
+		return "", nil
+	}
+
+	var value strings.Builder
+	switch quote := parser.peek(); quote {
+	case '\'':
+		start := parser.position
+		parser.position++
+		for !parser.done() && parser.peek() != '\'' {
+			value.WriteRune(parser.peek())
+			parser.position++
+		}
+		if parser.done() {
+			return "", parser.errorf(start, "unterminated quoted value")
+		}
+		parser.position++
+		return value.String(), nil
+	case '"':
+		start := parser.position
+		parser.position++
+		for !parser.done() && parser.peek() != '"' {
+			if err := parser.character(&value); err != nil {
+				return "", err
+			}
+		}
+		if parser.done() {
+			return "", parser.errorf(start, "unterminated quoted value")
+		}
+		parser.position++
+		return value.String(), nil
+	default:
+		// Unquoted values are taken literally up to the next comma, so Windows paths and regular expressions
+		// don't need escaping
+		start := parser.position
+		for !parser.done() && parser.peek() != ',' {
+			parser.position++
+		}
+		return strings.TrimRight(string(parser.runes[start:parser.position]), " \t\n\r"), nil
+	}
+}
+
+// character writes the character at the position to value, resolving escapes
+func (parser *configParser) character(value *strings.Builder) error {
+	character := parser.peek()
+	parser.position++
+	if character != '\\' {
+		value.WriteRune(character)
+		return nil
+	}
+	if parser.done() {
+		return parser.errorf(parser.position-1, "expected an escaped character after \\")
+	}
+	escaped, ok := configEscapes[parser.peek()]
+	if !ok {
+		return parser.errorf(parser.position-1, "unknown escape \\%c", parser.peek())
+	}
+	value.WriteRune(escaped)
+	parser.position++
+	return nil
+}
+
+// parseConfigAnnotation parses the NAME=value pairs of a config annotation into env vars
+func parseConfigAnnotation(annotation, config string) ([]corev1.EnvVar, error) {
+	parser := configParser{
+		annotation: annotation,
+		runes:      []rune(config),
+	}
+	return parser.parse()
+}
+
+// parseConfigJSONAnnotation parses a map of env var names to values, or a list of env vars, in JSON or YAML
+func parseConfigJSONAnnotation(annotation, config string) ([]corev1.EnvVar, error) {
+	data := []byte(config)
+	trimmed := strings.TrimSpace(config)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		var err error
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v is invalid: %v", annotation, err)
+		}
+	}
+
+	var envVars []corev1.EnvVar
+	var values map[string]interface{}
+	var list []struct {
+		Name  string      `json:"name"`
+		Value interface{} `json:"value"`
+	}
+	switch err := json.Unmarshal(data, &values); {
+	case err == nil:
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, err := configValue(values[name])
+			if err != nil {
+				return nil, fmt.Errorf("%v is invalid: %v %v", annotation, name, err)
+			}
+			envVars = append(envVars, corev1.EnvVar{Name: name, Value: value})
+		}
+	case json.Unmarshal(data, &list) == nil:
+		for i, item := range list {
+			if len(item.Name) == 0 {
+				return nil, fmt.Errorf("%v is invalid: env var %v is missing a name", annotation, i)
+			}
+			value, err := configValue(item.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%v is invalid: %v %v", annotation, item.Name, err)
+			}
+			envVars = append(envVars, corev1.EnvVar{Name: item.Name, Value: value})
+		}
+	default:
+		var syntaxErr *json.SyntaxError
+		// Positions are only reported for JSON, YAML was already converted and reports its own line
+		if errors.As(err, &syntaxErr) && syntaxErr.Offset > 0 && string(data) == config {
+			return nil, fmt.Errorf("%v is invalid at character %v: %v", annotation, utf8.RuneCount(data[:syntaxErr.Offset-1])+1, err)
+		}
+		return nil, fmt.Errorf("%v is invalid: expected a map of env var names to values or a list of env vars", annotation)
+	}
+
+	for _, envVar := range envVars {
+		if errs := validation.IsEnvVarName(envVar.Name); len(errs) != 0 {
+			return nil, fmt.Errorf("%v is invalid: %q is not a valid env var name", annotation, envVar.Name)
+		}
+	}
+	return envVars, nil
+}
+
+// configValue returns the env var value of a scalar JSON value
+func configValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case nil:
+		return "", nil
+	case bool, float64:
+		data, err := json.Marshal(value)
+		return string(data), err
+	default:
+		return "", fmt.Errorf("must be a string, number or boolean")
+	}
+}
+
+// validateConfigYAMLAnnotation checks that config is a YAML map of contrast_security.yaml settings, and that it
+// doesn't override the API settings of the secret unless allowAPIOverrides is set
+func validateConfigYAMLAnnotation(config string, allowAPIOverrides bool) error {
+	overrides, err := mergeconfig.ParseOverrides([]byte(config))
+	if err != nil {
+		return fmt.Errorf("%v is invalid: %v", injectorConfigYAMLAnnotation, err)
+	}
+	if allowAPIOverrides {
+		return nil
+	}
+	if protected := mergeconfig.ProtectedKeys(overrides, []string{protectedConfigKey}); len(protected) != 0 {
+		return fmt.Errorf("%v can't override %v, the %v settings of the contrast_security.yaml secret are protected",
+			injectorConfigYAMLAnnotation, strings.Join(protected, ", "), protectedConfigKey)
+	}
+	return nil
+}
+
+// configMerge describes the config overrides of a Pod, merged over the contrast_security.yaml of the secret by
+// the config merge init container
+type configMerge struct {
+	// overrides is the YAML fragment of the config-yaml annotation
+	overrides string
+	// configMap is the ConfigMap key holding a YAML fragment merged before the overrides, if set
+	configMap *configMapSource
+	// protectAPI stops the overrides from changing the api settings of the secret
+	protectAPI bool
+}
+
+// render returns the init container merging the overrides into the merged config sub path of the agent volume,
+// and the volumes it needs in addition to the agent volumes
+func (merge configMerge) render(injectorImage, failurePolicy string) (corev1.Container, []corev1.Volume) {
+	container := corev1.Container{
+		Name:    configMergeContainerName,
+		Image:   injectorImage,
+		Command: []string{"/contrast-agent-injector", "merge-config"},
+		Args: []string{
+			"--base", "/opt/contrast-base/contrast_security.yaml",
+			"--output", mergedConfigPath + "/contrast_security.yaml",
+		},
+		Env: []corev1.EnvVar{{Name: "CONTRAST_CONFIG_OVERRIDES", Value: merge.overrides}},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "contrast-agent-injector",
+				MountPath: mergedConfigPath,
+				SubPath:   mergedConfigSubPath,
+			},
+			{
+				Name:      "contrast-agent-injector-yaml",
+				MountPath: "/opt/contrast-base",
+				ReadOnly:  true,
+			},
+		},
+	}
+	if merge.protectAPI {
+		container.Args = append(container.Args, "--protected", protectedConfigKey)
+	}
+	if failurePolicy == FailurePolicyOpen {
+		container.Env = append(container.Env, corev1.EnvVar{Name: "CONTRAST_FAILURE_POLICY", Value: FailurePolicyOpen})
+	}
+
+	var volumes []corev1.Volume
+	if merge.configMap != nil {
+		container.Args = append(container.Args, "--overrides-file", configFromMountPath+"/"+configFromFileName)
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      configFromVolumeName,
+			MountPath: configFromMountPath,
+			ReadOnly:  true,
+		})
+		volumes = append(volumes, merge.configMap.volume())
+	}
+	return container, volumes
+}
+
+// mergedConfigVolumeMount returns the read only mount of the merged config for the containers the agent is injected into
+func mergedConfigVolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      "contrast-agent-injector",
+		MountPath: mergedConfigPath,
+		SubPath:   mergedConfigSubPath,
+		ReadOnly:  true,
+	}
+}
+
+// setEnvVar returns envVars with the value of name replaced, or with name added when it isn't set
+func setEnvVar(envVars []corev1.EnvVar, name, value string) []corev1.EnvVar {
+	result := append([]corev1.EnvVar{}, envVars...)
+	for i := range result {
+		if result[i].Name == name {
+			result[i] = corev1.EnvVar{Name: name, Value: value}
+			return result
+		}
+	}
+	return append(result, corev1.EnvVar{Name: name, Value: value})
+}
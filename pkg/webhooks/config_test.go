@@ -0,0 +1,206 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseConfigAnnotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		envVars []corev1.EnvVar
+		err     string
+	}{
+		{
+			name:   "unquoted",
+			config: "CONTRAST__SERVER__ENVIRONMENT=qa, CONTRAST__SERVER__NAME=webgoat-k8s",
+			envVars: []corev1.EnvVar{
+				{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "qa"},
+				{Name: "CONTRAST__SERVER__NAME", Value: "webgoat-k8s"},
+			},
+		},
+		{
+			name:   "quoted",
+			config: `CONTRAST__APPLICATION__TAGS="team-a,payments", CONTRAST__SERVER__TAGS='k8s,"qa"'`,
+			envVars: []corev1.EnvVar{
+				{Name: "CONTRAST__APPLICATION__TAGS", Value: "team-a,payments"},
+				{Name: "CONTRAST__SERVER__TAGS", Value: `k8s,"qa"`},
+			},
+		},
+		{
+			name:   "escapes",
+			config: `A="say \"hi\"\tand\\\,", C=`,
+			envVars: []corev1.EnvVar{
+				{Name: "A", Value: "say \"hi\"\tand\\,"},
+				{Name: "C", Value: ""},
+			},
+		},
+		{
+			name:   "unquoted backslashes",
+			config: `CONTRAST__AGENT__LOGGER__PATH=C:\logs\contrast.log, CONTRAST__ASSESS__PATTERN=\d+\.\w, TRAILING=b\`,
+			envVars: []corev1.EnvVar{
+				{Name: "CONTRAST__AGENT__LOGGER__PATH", Value: `C:\logs\contrast.log`},
+				{Name: "CONTRAST__ASSESS__PATTERN", Value: `\d+\.\w`},
+				{Name: "TRAILING", Value: `b\`},
+			},
+		},
+		{
+			name:    "value containing equals",
+			config:  "JAVA_TOOL_OPTIONS=-Dkey=value,,",
+			envVars: []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Dkey=value"}},
+		},
+		{
+			name:   "missing equals",
+			config: "A=b, CONTRAST",
+			err:    `contrast-agent-injector/config is invalid at character 14: expected = after "CONTRAST"`,
+		},
+		{
+			name:   "missing name",
+			config: "A=b, =c",
+			err:    `contrast-agent-injector/config is invalid at character 6: expected an env var name before =`,
+		},
+		{
+			name:   "invalid name",
+			config: "A B=c",
+			err:    `contrast-agent-injector/config is invalid at character 1: "A B" is not a valid env var name`,
+		},
+		{
+			name:   "unterminated quote",
+			config: `A="b, C=d`,
+			err:    `contrast-agent-injector/config is invalid at character 3: unterminated quoted value`,
+		},
+		{
+			name:   "text after quote",
+			config: `A="b"c, D=e`,
+			err:    `contrast-agent-injector/config is invalid at character 6: expected , after the value of A`,
+		},
+		{
+			name:   "unknown escape",
+			config: `A="b\q"`,
+			err:    `contrast-agent-injector/config is invalid at character 5: unknown escape \q`,
+		},
+		{
+			name:   "trailing backslash",
+			config: `A="b\`,
+			err:    `contrast-agent-injector/config is invalid at character 5: expected an escaped character after \`,
+		},
+		{
+			name:   "multibyte characters",
+			config: `A=é, ü`,
+			err:    `contrast-agent-injector/config is invalid at character 7: expected = after "ü"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envVars, err := parseConfigAnnotation(injectorConfigAnnotation, test.config)
+			if len(test.err) != 0 {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.envVars, envVars)
+		})
+	}
+}
+
+func TestParseConfigJSONAnnotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		envVars []corev1.EnvVar
+		err     string
+	}{
+		{
+			name:   "map",
+			config: `{"CONTRAST__SERVER__NAME": "webgoat-k8s", "CONTRAST__APPLICATION__TAGS": "team-a,payments", "CONTRAST__ENABLE": true, "CONTRAST__PORT": 8080}`,
+			envVars: []corev1.EnvVar{
+				{Name: "CONTRAST__APPLICATION__TAGS", Value: "team-a,payments"},
+				{Name: "CONTRAST__ENABLE", Value: "true"},
+				{Name: "CONTRAST__PORT", Value: "8080"},
+				{Name: "CONTRAST__SERVER__NAME", Value: "webgoat-k8s"},
+			},
+		},
+		{
+			name:   "list",
+			config: `[{"name": "CONTRAST__SERVER__NAME", "value": "webgoat-k8s"}, {"name": "CONTRAST__SERVER__ENVIRONMENT", "value": "qa"}]`,
+			envVars: []corev1.EnvVar{
+				{Name: "CONTRAST__SERVER__NAME", Value: "webgoat-k8s"},
+				{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "qa"},
+			},
+		},
+		{
+			name: "yaml map",
+			config: `
+CONTRAST__SERVER__ENVIRONMENT: qa
+CONTRAST__APPLICATION__TAGS: team-a,payments
+`,
+			envVars: []corev1.EnvVar{
+				{Name: "CONTRAST__APPLICATION__TAGS", Value: "team-a,payments"},
+				{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "qa"},
+			},
+		},
+		{
+			name: "yaml list",
+			config: `
+- name: CONTRAST__SERVER__ENVIRONMENT
+  value: qa
+`,
+			envVars: []corev1.EnvVar{{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "qa"}},
+		},
+		{
+			name:   "json syntax error",
+			config: `{"A": "b",, "C": "d"}`,
+			err:    `contrast-agent-injector/config-json is invalid at character 11: invalid character ',' looking for beginning of object key string`,
+		},
+		{
+			name:   "yaml syntax error",
+			config: "A: b\n  C: d: e",
+			err:    `contrast-agent-injector/config-json is invalid: yaml: line 2: mapping values are not allowed in this context`,
+		},
+		{
+			name:   "scalar",
+			config: `qa`,
+			err:    `contrast-agent-injector/config-json is invalid: expected a map of env var names to values or a list of env vars`,
+		},
+		{
+			name:   "nested value",
+			config: `{"A": {"B": "c"}}`,
+			err:    `contrast-agent-injector/config-json is invalid: A must be a string, number or boolean`,
+		},
+		{
+			name:   "missing name",
+			config: `[{"value": "qa"}]`,
+			err:    `contrast-agent-injector/config-json is invalid: env var 0 is missing a name`,
+		},
+		{
+			name:   "invalid name",
+			config: `{"A B": "c"}`,
+			err:    `contrast-agent-injector/config-json is invalid: "A B" is not a valid env var name`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envVars, err := parseConfigJSONAnnotation(injectorConfigJSONAnnotation, test.config)
+			if len(test.err) != 0 {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.envVars, envVars)
+		})
+	}
+}
+
+func TestValidateConfigYAMLAnnotation(t *testing.T) {
+	assert.NoError(t, validateConfigYAMLAnnotation("server:\n  environment: qa\n", false))
+	assert.NoError(t, validateConfigYAMLAnnotation("", false))
+	assert.NoError(t, validateConfigYAMLAnnotation("api:\n  url: https://eval.contrastsecurity.com/Contrast\n", true))
+
+	assert.EqualError(t, validateConfigYAMLAnnotation("API:\n  url: https://example.com\napi.api_key: other\n", false),
+		"contrast-agent-injector/config-yaml can't override API, api.api_key, the api settings of the contrast_security.yaml secret are protected")
+	assert.EqualError(t, validateConfigYAMLAnnotation("- server", false),
+		"contrast-agent-injector/config-yaml is invalid: the config overrides must be a map of contrast_security.yaml settings")
+}
@@ -0,0 +1,176 @@
+package webhooks
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cbuto/contrast-agent-injector/pkg/mergeconfig"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// injectorConfigFromAnnotation references agent configuration managed in a ConfigMap: configmap/<name> injects
+	// the keys of the ConfigMap as env vars, configmap/<name>/<key> merges the YAML fragment in the key over the
+	// contrast_security.yaml of the secret
+	injectorConfigFromAnnotation = `contrast-agent-injector/config-from`
+	// configFromVolumeName is the volume of the ConfigMap key holding a YAML fragment
+	configFromVolumeName = `contrast-agent-injector-config-from`
+	configFromMountPath  = `/opt/contrast-overrides`
+	configFromFileName   = `contrast_security.yaml`
+)
+
+// ConfigMapLister gets ConfigMaps, usually from the cache of a ConfigMap informer
+type ConfigMapLister interface {
+	ConfigMaps(namespace string) corelisters.ConfigMapNamespaceLister
+}
+
+// configMapSource is a ConfigMap referenced by a config-from annotation, and the key of a YAML fragment if set
+type configMapSource struct {
+	annotation string
+	name       string
+	key        string
+}
+
+// parseConfigFromAnnotation parses configmap/<name> or configmap/<name>/<key>
+func parseConfigFromAnnotation(annotation, value string) (configMapSource, error) {
+	parts := strings.Split(strings.TrimSpace(value), "/")
+	if (len(parts) != 2 && len(parts) != 3) || !strings.EqualFold(parts[0], "configmap") {
+		return configMapSource{}, fmt.Errorf("%v must be configmap/<name> or configmap/<name>/<key>", annotation)
+	}
+	source := configMapSource{annotation: annotation, name: parts[1]}
+	if errs := validation.IsDNS1123Subdomain(source.name); len(errs) != 0 {
+		return configMapSource{}, fmt.Errorf("%v is invalid: %q is not a valid ConfigMap name", annotation, source.name)
+	}
+	if len(parts) == 3 {
+		source.key = parts[2]
+		if errs := validation.IsConfigMapKey(source.key); len(errs) != 0 {
+			return configMapSource{}, fmt.Errorf("%v is invalid: %q is not a valid ConfigMap key", annotation, source.key)
+		}
+	}
+	return source, nil
+}
+
+// envFrom returns the env var source injecting the keys of the ConfigMap
+func (source configMapSource) envFrom() corev1.EnvFromSource {
+	return corev1.EnvFromSource{
+		ConfigMapRef: &corev1.ConfigMapEnvSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: source.name},
+		},
+	}
+}
+
+// volume returns the volume containing the YAML fragment in the key of the ConfigMap
+func (source configMapSource) volume() corev1.Volume {
+	return corev1.Volume{
+		Name: configFromVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: source.name},
+				Items:                []corev1.KeyToPath{{Key: source.key, Path: configFromFileName}},
+			},
+		},
+	}
+}
+
+// configFromSources returns the ConfigMaps referenced by the config-from annotations of the Pod and the containers
+func configFromSources(annotations map[string]string, containerNames []string) ([]configMapSource, error) {
+	names := []string{injectorConfigFromAnnotation}
+	for _, containerName := range containerNames {
+		names = append(names, containerAnnotation(injectorConfigFromAnnotation, containerName))
+	}
+	var sources []configMapSource
+	for _, annotation := range names {
+		value, ok := annotations[annotation]
+		if !ok {
+			continue
+		}
+		source, err := parseConfigFromAnnotation(annotation, value)
+		if err != nil {
+			return nil, err
+		}
+		// The YAML fragment is merged into the config of every agent of the Pod
+		if len(source.key) != 0 && annotation != injectorConfigFromAnnotation {
+			return nil, fmt.Errorf("%v can only reference a ConfigMap, YAML fragments are referenced by the %v annotation of the Pod",
+				annotation, injectorConfigFromAnnotation)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// checkConfigMap warns when the ConfigMap of source doesn't exist in the namespace of the Pod, the Pod won't start
+// until it is created. The YAML fragment of an existing ConfigMap is validated like the config-yaml annotation.
+func (agentPatch AgentPatch) checkConfigMap(source configMapSource) error {
+	if agentPatch.configMaps == nil || len(agentPatch.namespace) == 0 {
+		return nil
+	}
+	configMap, err := agentPatch.configMaps.ConfigMaps(agentPatch.namespace).Get(source.name)
+	if errors.IsNotFound(err) {
+		agentPatch.warn("ConfigMap %v referenced by %v doesn't exist in namespace %v, the Pod won't start until it is created",
+			source.name, source.annotation, agentPatch.namespace)
+		return nil
+	}
+	if err != nil {
+		agentPatch.warn("Could not check that ConfigMap %v referenced by %v exists: %v", source.name, source.annotation, err)
+		return nil
+	}
+	if len(source.key) == 0 {
+		return nil
+	}
+
+	fragment, ok := configMap.Data[source.key]
+	if !ok {
+		agentPatch.warn("ConfigMap %v referenced by %v doesn't have the key %v, the Pod won't start until it is added",
+			source.name, source.annotation, source.key)
+		return nil
+	}
+	overrides, err := mergeconfig.ParseOverrides([]byte(fragment))
+	if err != nil {
+		return fmt.Errorf("%v is invalid: ConfigMap %v key %v: %v", source.annotation, source.name, source.key, err)
+	}
+	if agentPatch.allowConfigAPIOverrides {
+		return nil
+	}
+	if protected := mergeconfig.ProtectedKeys(overrides, []string{protectedConfigKey}); len(protected) != 0 {
+		return fmt.Errorf("%v can't override %v, the %v settings of the contrast_security.yaml secret are protected",
+			source.annotation, strings.Join(protected, ", "), protectedConfigKey)
+	}
+	return nil
+}
+
+// addEnvFrom returns the patches adding the ConfigMaps the container doesn't reference yet
+func addEnvFrom(existingSources, sourcesToAdd []corev1.EnvFromSource, basePath string) (patch []patchOperation) {
+	first := len(existingSources) == 0
+	referenced := func(sources []corev1.EnvFromSource, source corev1.EnvFromSource) bool {
+		for _, existing := range sources {
+			if existing.ConfigMapRef != nil && existing.ConfigMapRef.Name == source.ConfigMapRef.Name && existing.Prefix == source.Prefix {
+				return true
+			}
+		}
+		return false
+	}
+	var added []corev1.EnvFromSource
+	for _, source := range sourcesToAdd {
+		if referenced(existingSources, source) || referenced(added, source) {
+			continue
+		}
+		added = append(added, source)
+
+		var value interface{} = source
+		path := basePath + "/-"
+		if first {
+			first = false
+			value = []corev1.EnvFromSource{source}
+			path = basePath
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
@@ -0,0 +1,200 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admission "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+func configMapLister(t *testing.T, configMaps ...*corev1.ConfigMap) ConfigMapLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, configMap := range configMaps {
+		assert.NoError(t, indexer.Add(configMap))
+	}
+	return corelisters.NewConfigMapLister(indexer)
+}
+
+func TestParseConfigFromAnnotation(t *testing.T) {
+	source, err := parseConfigFromAnnotation(injectorConfigFromAnnotation, "configmap/contrast-config")
+	assert.NoError(t, err)
+	assert.Equal(t, configMapSource{annotation: injectorConfigFromAnnotation, name: "contrast-config"}, source)
+
+	source, err = parseConfigFromAnnotation(injectorConfigFromAnnotation, " ConfigMap/contrast-config/contrast_security.yaml ")
+	assert.NoError(t, err)
+	assert.Equal(t, configMapSource{annotation: injectorConfigFromAnnotation, name: "contrast-config", key: "contrast_security.yaml"}, source)
+
+	_, err = parseConfigFromAnnotation(injectorConfigFromAnnotation, "secret/contrast-config")
+	assert.EqualError(t, err, "contrast-agent-injector/config-from must be configmap/<name> or configmap/<name>/<key>")
+	_, err = parseConfigFromAnnotation(injectorConfigFromAnnotation, "configmap/Contrast_Config")
+	assert.EqualError(t, err, `contrast-agent-injector/config-from is invalid: "Contrast_Config" is not a valid ConfigMap name`)
+	_, err = parseConfigFromAnnotation(injectorConfigFromAnnotation, "configmap/contrast-config/a:b")
+	assert.EqualError(t, err, `contrast-agent-injector/config-from is invalid: "a:b" is not a valid ConfigMap key`)
+}
+
+func TestMutateConfigFrom(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+    contrast-agent-injector/container: webgoat,sidecar
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+  - name: sidecar
+    image: webgoat/webgoat-8.0
+    envFrom:
+    - configMapRef:
+        name: sidecar-config
+`
+	configMaps := configMapLister(t,
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "contrast-config", Namespace: "team-a"},
+			Data:       map[string]string{"CONTRAST__SERVER__ENVIRONMENT": "qa"},
+		},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "sidecar-config", Namespace: "team-a"}},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "contrast-yaml", Namespace: "team-a"},
+			Data: map[string]string{
+				"overrides.yaml": "agent:\n  logger:\n    level: DEBUG\n",
+				"api.yaml":       "api:\n  api_key: other\n",
+			},
+		},
+	)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		envFrom     map[string][]string
+		volume      *corev1.Volume
+		warnings    []string
+		err         string
+	}{
+		{
+			name:        "env vars",
+			annotations: map[string]string{injectorConfigFromAnnotation: "configmap/contrast-config"},
+			envFrom:     map[string][]string{"webgoat": {"contrast-config"}, "sidecar": {"contrast-config"}},
+		},
+		{
+			name: "per container",
+			annotations: map[string]string{
+				injectorConfigFromAnnotation:                                 "configmap/contrast-config",
+				containerAnnotation(injectorConfigFromAnnotation, "sidecar"): "configmap/sidecar-config",
+			},
+			envFrom: map[string][]string{"webgoat": {"contrast-config"}, "sidecar": {"contrast-config"}},
+		},
+		{
+			name:        "missing",
+			annotations: map[string]string{injectorConfigFromAnnotation: "configmap/missing"},
+			envFrom:     map[string][]string{"webgoat": {"missing"}, "sidecar": {"missing"}},
+			warnings:    []string{"ConfigMap missing referenced by contrast-agent-injector/config-from doesn't exist in namespace team-a, the Pod won't start until it is created"},
+		},
+		{
+			name:        "yaml fragment",
+			annotations: map[string]string{injectorConfigFromAnnotation: "configmap/contrast-yaml/overrides.yaml"},
+			volume:      &corev1.Volume{Name: configFromVolumeName, VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "contrast-yaml"}, Items: []corev1.KeyToPath{{Key: "overrides.yaml", Path: configFromFileName}}}}},
+		},
+		{
+			name:        "missing key",
+			annotations: map[string]string{injectorConfigFromAnnotation: "configmap/contrast-yaml/missing.yaml"},
+			volume:      &corev1.Volume{Name: configFromVolumeName, VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "contrast-yaml"}, Items: []corev1.KeyToPath{{Key: "missing.yaml", Path: configFromFileName}}}}},
+			warnings:    []string{"ConfigMap contrast-yaml referenced by contrast-agent-injector/config-from doesn't have the key missing.yaml, the Pod won't start until it is added"},
+		},
+		{
+			name:        "api override",
+			annotations: map[string]string{injectorConfigFromAnnotation: "configmap/contrast-yaml/api.yaml"},
+			err:         "contrast-agent-injector/config-from can't override api, the api settings of the contrast_security.yaml secret are protected",
+		},
+		{
+			name:        "per container yaml fragment",
+			annotations: map[string]string{containerAnnotation(injectorConfigFromAnnotation, "sidecar"): "configmap/contrast-yaml/overrides.yaml"},
+			err:         "contrast-agent-injector/config-from.sidecar can only reference a ConfigMap, YAML fragments are referenced by the contrast-agent-injector/config-from annotation of the Pod",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := corev1.Pod{}
+			assert.NoError(t, yaml.Unmarshal([]byte(podYaml), &pod))
+			for key, value := range test.annotations {
+				pod.Annotations[key] = value
+			}
+			podJSON, err := yaml.Marshal(pod)
+			assert.NoError(t, err)
+			podJSON, err = yaml.YAMLToJSON(podJSON)
+			assert.NoError(t, err)
+
+			mutateConfig := &MutateConfig{
+				SecretName: "test",
+				ConfigMaps: configMaps,
+			}
+			patches, warnings, err := mutateConfig.mutate(&admission.AdmissionRequest{
+				Resource:  podResource,
+				Namespace: "team-a",
+				Object:    runtime.RawExtension{Raw: podJSON},
+			})
+			if len(test.err) != 0 {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.warnings, warnings)
+
+			patched, err := applyPatches(podJSON, patches)
+			assert.NoError(t, err)
+			envFrom := map[string][]string{}
+			for _, container := range patched.Spec.Containers {
+				for _, source := range container.EnvFrom {
+					if source.ConfigMapRef.Name != "sidecar-config" {
+						envFrom[container.Name] = append(envFrom[container.Name], source.ConfigMapRef.Name)
+					}
+				}
+			}
+			if test.envFrom == nil {
+				test.envFrom = map[string][]string{}
+			}
+			assert.Equal(t, test.envFrom, envFrom)
+			// The sidecar keeps its own ConfigMap
+			assert.Equal(t, "sidecar-config", patched.Spec.Containers[1].EnvFrom[0].ConfigMapRef.Name)
+
+			var configContainer *corev1.Container
+			for i := range patched.Spec.InitContainers {
+				if patched.Spec.InitContainers[i].Name == configMergeContainerName {
+					configContainer = &patched.Spec.InitContainers[i]
+				}
+			}
+			if test.volume == nil {
+				assert.Nil(t, configContainer)
+				return
+			}
+			assert.Contains(t, patched.Spec.Volumes, *test.volume)
+			assert.NotNil(t, configContainer)
+			assert.Contains(t, configContainer.Args, "/opt/contrast-overrides/contrast_security.yaml")
+			assert.Contains(t, configContainer.Args, "--protected")
+		})
+	}
+}
+
+func TestAddEnvFrom(t *testing.T) {
+	contrast := configMapSource{name: "contrast-config"}.envFrom()
+	other := configMapSource{name: "other"}.envFrom()
+
+	patches := addEnvFrom(nil, []corev1.EnvFromSource{contrast, contrast, other}, "/spec/containers/0/envFrom")
+	assert.Equal(t, []patchOperation{
+		{Op: "add", Path: "/spec/containers/0/envFrom", Value: []corev1.EnvFromSource{contrast}},
+		{Op: "add", Path: "/spec/containers/0/envFrom/-", Value: other},
+	}, patches)
+
+	assert.Empty(t, addEnvFrom([]corev1.EnvFromSource{contrast}, []corev1.EnvFromSource{contrast}, "/spec/containers/0/envFrom"))
+}
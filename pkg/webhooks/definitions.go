@@ -0,0 +1,482 @@
+package webhooks
+
+import (
+	"bytes"
+	_ "embed" // embeds the default agent definitions
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DeliveryDownload stages the agent with the init container declared in the agent definition
+	DeliveryDownload = `download`
+	// DeliveryImage copies the agent out of a versioned agent image
+	DeliveryImage = `image`
+)
+
+// DefaultInjectorImage is the injector image used by init containers running the fetch-agent command
+const DefaultInjectorImage = `ghcr.io/cbuto/contrast-agent-injector:latest`
+
+//go:embed agents.yaml
+var defaultAgentDefinitions []byte
+
+// AgentRegistry maps a language, as set in the contrast-agent-injector/language annotation, to the
+// definition of the agent injected for it
+type AgentRegistry map[string]AgentDefinition
+
+// AgentDefinitions is the format of the file passed with --agentsConfig
+type AgentDefinitions struct {
+	Agents []AgentDefinition `json:"agents"`
+	// ArtifactMirrors replaces the artifact URL of the agent for a language
+	ArtifactMirrors map[string]ArtifactMirror `json:"artifactMirrors,omitempty"`
+	// Verification sets how the artifact of the agent for a language is verified
+	Verification map[string]ArtifactVerification `json:"verification,omitempty"`
+	// VersionPolicies restricts the agent versions Pods can request for a language
+	VersionPolicies map[string]VersionPolicy `json:"versionPolicies,omitempty"`
+}
+
+// ArtifactMirror is an internal repository, such as Artifactory or Nexus, the agent for a language is downloaded from
+type ArtifactMirror struct {
+	URL string `json:"url"`
+	// MetadataURL replaces the URL of the maven-metadata.xml latest and version ranges are resolved against
+	MetadataURL string `json:"metadataUrl,omitempty"`
+	// CredentialsSecret is a Secret in the Pod's namespace with the username and password keys for the mirror
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+}
+
+// AgentDefinition declares how the agent for a language is staged into the agent volume by an
+// init container and how the target container loads it. Image, args and env var values are templates.
+type AgentDefinition struct {
+	Language      string                  `json:"language"`
+	InitContainer InitContainerDefinition `json:"initContainer"`
+	Volumes       []corev1.Volume         `json:"volumes,omitempty"`
+	VolumeMounts  []corev1.VolumeMount    `json:"volumeMounts,omitempty"`
+	Env           []corev1.EnvVar         `json:"env,omitempty"`
+	Detect        DetectionRules          `json:"detect,omitempty"`
+	AgentImage    *AgentImageDefinition   `json:"agentImage,omitempty"`
+	Artifact      *ArtifactDefinition     `json:"artifact,omitempty"`
+	VersionPolicy *VersionPolicy          `json:"versionPolicy,omitempty"`
+}
+
+// ArtifactDefinition is the agent artifact downloaded by the init container. The URL is a template with
+// {{.Group}}, {{.Artifact}} and {{.Version}} placeholders, the rendered URL is available to the init container
+// templates as {{.ArtifactURL}}. The username and password keys of the credentials secret are exposed to the
+// init container as the CONTRAST_MIRROR_USERNAME and CONTRAST_MIRROR_PASSWORD env vars, registries don't support them.
+// The MetadataURL is a template with {{.Group}} and {{.Artifact}} placeholders pointing at the maven-metadata.xml
+// of the artifact, when it is set latest and version ranges such as 3.x are resolved to a concrete version.
+// Registry marks the URL as a package registry the agent is installed from, rather than the agent file itself.
+type ArtifactDefinition struct {
+	Group             string                `json:"group,omitempty"`
+	Artifact          string                `json:"artifact"`
+	URL               string                `json:"url"`
+	MetadataURL       string                `json:"metadataUrl,omitempty"`
+	Registry          bool                  `json:"registry,omitempty"`
+	CredentialsSecret string                `json:"credentialsSecret,omitempty"`
+	Verification      *ArtifactVerification `json:"verification,omitempty"`
+}
+
+// InitContainerDefinition is the init container that stages the agent into /opt/contrast
+type InitContainerDefinition struct {
+	Image        string               `json:"image"`
+	Command      []string             `json:"command,omitempty"`
+	Args         []string             `json:"args,omitempty"`
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+}
+
+// AgentImageDefinition is the agent image used by the image delivery mode. The image is tagged with the
+// agent version and the command and args copy the agent from the image into /opt/contrast.
+type AgentImageDefinition struct {
+	Repository string   `json:"repository"`
+	Command    []string `json:"command,omitempty"`
+	Args       []string `json:"args,omitempty"`
+}
+
+// agentTemplateData is the data available to the templates of an agent definition
+type agentTemplateData struct {
+	Version        string
+	ContainerName  string
+	ContainerImage string
+	InjectorImage  string
+	Group          string
+	Artifact       string
+	ArtifactURL    string
+}
+
+var defaultAgentRegistry = mustLoadDefaultAgentRegistry()
+
+func mustLoadDefaultAgentRegistry() AgentRegistry {
+	registry, err := parseAgentDefinitions(defaultAgentDefinitions, AgentRegistry{})
+	if err != nil {
+		panic(fmt.Sprintf("invalid default agent definitions: %v", err))
+	}
+	return registry
+}
+
+// DefaultAgentRegistry returns a registry containing the agents supported out of the box
+func DefaultAgentRegistry() AgentRegistry {
+	registry := AgentRegistry{}
+	for language, definition := range defaultAgentRegistry {
+		registry[language] = definition
+	}
+	return registry
+}
+
+// LoadAgentRegistry returns the default agents with the definitions from the file at path layered on top,
+// a definition in the file replaces the default definition for the same language
+func LoadAgentRegistry(path string) (AgentRegistry, error) {
+	registry := DefaultAgentRegistry()
+	if len(path) == 0 {
+		return registry, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read agent definitions: %v", err)
+	}
+
+	return parseAgentDefinitions(data, registry)
+}
+
+func parseAgentDefinitions(data []byte, registry AgentRegistry) (AgentRegistry, error) {
+	var definitions AgentDefinitions
+	if err := yaml.UnmarshalStrict(data, &definitions); err != nil {
+		return nil, fmt.Errorf("could not parse agent definitions: %v", err)
+	}
+
+	for _, definition := range definitions.Agents {
+		if err := definition.validate(); err != nil {
+			return nil, err
+		}
+		if err := definition.Detect.compile(); err != nil {
+			return nil, fmt.Errorf("agent definition for %v is invalid: %v", definition.Language, err)
+		}
+		registry[strings.ToLower(definition.Language)] = definition
+	}
+
+	for language, mirror := range definitions.ArtifactMirrors {
+		definition, ok := registry[strings.ToLower(language)]
+		if !ok || definition.Artifact == nil {
+			return nil, fmt.Errorf("artifact mirror for %v is invalid: no agent artifact is defined for %v", language, language)
+		}
+		artifact := *definition.Artifact
+		artifact.URL = mirror.URL
+		artifact.CredentialsSecret = mirror.CredentialsSecret
+		if len(mirror.MetadataURL) != 0 {
+			artifact.MetadataURL = mirror.MetadataURL
+		}
+		definition.Artifact = &artifact
+		if err := definition.validate(); err != nil {
+			return nil, fmt.Errorf("artifact mirror for %v is invalid: %v", language, err)
+		}
+		registry[strings.ToLower(language)] = definition
+	}
+
+	for language, verification := range definitions.Verification {
+		definition, ok := registry[strings.ToLower(language)]
+		if !ok || definition.Artifact == nil {
+			return nil, fmt.Errorf("verification for %v is invalid: no agent artifact is defined for %v", language, language)
+		}
+		verification := verification
+		artifact := *definition.Artifact
+		artifact.Verification = &verification
+		definition.Artifact = &artifact
+		if err := definition.validate(); err != nil {
+			return nil, fmt.Errorf("verification for %v is invalid: %v", language, err)
+		}
+		registry[strings.ToLower(language)] = definition
+	}
+
+	for language, policy := range definitions.VersionPolicies {
+		definition, ok := registry[strings.ToLower(language)]
+		if !ok {
+			return nil, fmt.Errorf("version policy for %v is invalid: no agent is defined for %v", language, language)
+		}
+		policy := policy
+		definition.VersionPolicy = &policy
+		if err := definition.validate(); err != nil {
+			return nil, fmt.Errorf("version policy for %v is invalid: %v", language, err)
+		}
+		registry[strings.ToLower(language)] = definition
+	}
+
+	return registry, nil
+}
+
+// validate checks the required fields are set and renders every template with sample data,
+// so a broken definition fails at startup instead of at pod admission
+func (definition AgentDefinition) validate() error {
+	if len(definition.Language) == 0 {
+		return fmt.Errorf("agent definition is missing a language")
+	}
+	if len(definition.InitContainer.Image) == 0 {
+		return fmt.Errorf("agent definition for %v is missing an init container image", definition.Language)
+	}
+	if definition.AgentImage != nil && len(definition.AgentImage.Repository) == 0 {
+		return fmt.Errorf("agent definition for %v is missing an agent image repository", definition.Language)
+	}
+	if definition.Artifact != nil {
+		if err := definition.Artifact.validate(); err != nil {
+			return fmt.Errorf("agent definition for %v is invalid: %v", definition.Language, err)
+		}
+	}
+	if definition.VersionPolicy != nil {
+		if err := definition.VersionPolicy.validate(); err != nil {
+			return fmt.Errorf("agent definition for %v is invalid: %v", definition.Language, err)
+		}
+	}
+
+	sample := agentTemplateData{
+		Version:        "latest",
+		ContainerName:  "app",
+		ContainerImage: "app:latest",
+		InjectorImage:  DefaultInjectorImage,
+	}
+	deliveryModes := []string{DeliveryDownload}
+	if definition.AgentImage != nil {
+		deliveryModes = append(deliveryModes, DeliveryImage)
+	}
+	for _, delivery := range deliveryModes {
+		if _, _, err := definition.render(sample, nil, nil, delivery); err != nil {
+			return fmt.Errorf("agent definition for %v is invalid: %v", definition.Language, err)
+		}
+	}
+
+	return nil
+}
+
+// render executes the templates of the definition, returning the init container and env vars for the target container.
+// The name and the agent volume mount of the init container are set when the patches are generated.
+func (definition AgentDefinition) render(data agentTemplateData, existingEnvVars []corev1.EnvVar, annotations map[string]string, delivery string) (corev1.Container, []corev1.EnvVar, error) {
+	funcs := templateFuncs(existingEnvVars, annotations)
+
+	var initContainerEnvVars []corev1.EnvVar
+	if definition.Artifact != nil {
+		artifactURL, err := definition.Artifact.render(data)
+		if err != nil {
+			return corev1.Container{}, nil, err
+		}
+		data.Group = definition.Artifact.Group
+		data.Artifact = definition.Artifact.Artifact
+		data.ArtifactURL = artifactURL
+		if delivery == DeliveryDownload {
+			initContainerEnvVars = append(initContainerEnvVars,
+				corev1.EnvVar{Name: "CONTRAST_AGENT_ARTIFACT", Value: data.Artifact},
+				corev1.EnvVar{Name: "CONTRAST_AGENT_ARTIFACT_URL", Value: artifactURL},
+			)
+			initContainerEnvVars = append(initContainerEnvVars, definition.Artifact.credentialEnvVars()...)
+		}
+	}
+	// Scripts read the version from the env, templates would let the value change the script
+	if delivery == DeliveryDownload {
+		initContainerEnvVars = append([]corev1.EnvVar{{Name: "CONTRAST_AGENT_VERSION", Value: data.Version}}, initContainerEnvVars...)
+	}
+
+	imageTemplate := definition.InitContainer.Image
+	command := definition.InitContainer.Command
+	argTemplates := definition.InitContainer.Args
+	switch delivery {
+	case DeliveryDownload:
+	case DeliveryImage:
+		if definition.AgentImage == nil {
+			return corev1.Container{}, nil, fmt.Errorf("%v delivery is not supported for %v", delivery, definition.Language)
+		}
+		imageTemplate = fmt.Sprintf("%v:{{ .Version }}", definition.AgentImage.Repository)
+		command = definition.AgentImage.Command
+		argTemplates = definition.AgentImage.Args
+	default:
+		return corev1.Container{}, nil, fmt.Errorf("unknown delivery mode %v", delivery)
+	}
+
+	image, err := renderTemplate(imageTemplate, data, funcs)
+	if err != nil {
+		return corev1.Container{}, nil, fmt.Errorf("init container image: %v", err)
+	}
+
+	var args []string
+	for _, arg := range argTemplates {
+		renderedArg, err := renderTemplate(arg, data, funcs)
+		if err != nil {
+			return corev1.Container{}, nil, fmt.Errorf("init container args: %v", err)
+		}
+		args = append(args, renderedArg)
+	}
+
+	initContainer := corev1.Container{
+		Image:        image,
+		Command:      command,
+		Args:         args,
+		Env:          initContainerEnvVars,
+		VolumeMounts: definition.InitContainer.VolumeMounts,
+	}
+
+	var envVars []corev1.EnvVar
+	for _, envVar := range definition.Env {
+		value, err := renderTemplate(envVar.Value, data, funcs)
+		if err != nil {
+			return corev1.Container{}, nil, fmt.Errorf("env var %v: %v", envVar.Name, err)
+		}
+		envVar.Value = value
+		envVars = append(envVars, envVar)
+	}
+
+	return initContainer, envVars, nil
+}
+
+// render returns the URL of the artifact for the version in data
+func (artifact ArtifactDefinition) render(data agentTemplateData) (string, error) {
+	data.Group = artifact.Group
+	data.Artifact = artifact.Artifact
+	artifactURL, err := renderTemplate(artifact.URL, data, templateFuncs(nil, nil))
+	if err != nil {
+		return "", fmt.Errorf("artifact url: %v", err)
+	}
+	return artifactURL, nil
+}
+
+// renderMetadataURL returns the URL of the maven-metadata.xml of the artifact
+func (artifact ArtifactDefinition) renderMetadataURL() (string, error) {
+	metadataURL, err := renderTemplate(artifact.MetadataURL, agentTemplateData{Group: artifact.Group, Artifact: artifact.Artifact}, templateFuncs(nil, nil))
+	if err != nil {
+		return "", fmt.Errorf("metadata url: %v", err)
+	}
+	return metadataURL, nil
+}
+
+// validate checks the URL template renders to an absolute http(s) URL and the credentials secret is a valid name
+func (artifact ArtifactDefinition) validate() error {
+	if len(artifact.Artifact) == 0 {
+		return fmt.Errorf("artifact is missing a name")
+	}
+	artifactURL, err := artifact.render(agentTemplateData{Version: "1.0.0"})
+	if err != nil {
+		return err
+	}
+	if err := validateHTTPURL(artifactURL); err != nil {
+		return fmt.Errorf("artifact url %v %v", artifact.URL, err)
+	}
+	if len(artifact.MetadataURL) != 0 {
+		metadataURL, err := artifact.renderMetadataURL()
+		if err != nil {
+			return err
+		}
+		if err := validateHTTPURL(metadataURL); err != nil {
+			return fmt.Errorf("metadata url %v %v", artifact.MetadataURL, err)
+		}
+	}
+	if len(artifact.CredentialsSecret) != 0 {
+		// npm, pip and gem authenticate with their own config, the init container scripts don't pass the credentials
+		if artifact.Registry {
+			return fmt.Errorf("artifact credentials secret %v can't be used with a package registry, npm, pip and gem don't read the mirror credentials", artifact.CredentialsSecret)
+		}
+		if errs := validation.IsDNS1123Subdomain(artifact.CredentialsSecret); len(errs) != 0 {
+			return fmt.Errorf("artifact credentials secret %v is invalid: %v", artifact.CredentialsSecret, strings.Join(errs, ", "))
+		}
+	}
+	if artifact.Verification != nil {
+		// The injector downloads the agent and its signature itself, it can't read the credentials in the Pod's namespace
+		if artifact.Verification.Signature != nil && len(artifact.CredentialsSecret) != 0 {
+			return fmt.Errorf("artifact signature can't be verified with the credentials secret %v, the injector downloads the agent and its signature without credentials, pin checksums instead", artifact.CredentialsSecret)
+		}
+		if err := artifact.Verification.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateHTTPURL(rawURL string) error {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("is invalid: %v", err)
+	}
+	if (parsedURL.Scheme != "https" && parsedURL.Scheme != "http") || len(parsedURL.Host) == 0 {
+		return fmt.Errorf("must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// credentialEnvVars returns the env vars exposing the mirror credentials to the init container. The values are only
+// referenced from the secret, so they never appear in the Pod spec or in the injector logs.
+func (artifact ArtifactDefinition) credentialEnvVars() []corev1.EnvVar {
+	if len(artifact.CredentialsSecret) == 0 {
+		return nil
+	}
+	secretKeyRef := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: artifact.CredentialsSecret},
+				Key:                  key,
+			},
+		}
+	}
+	return []corev1.EnvVar{
+		{
+			Name:      "CONTRAST_MIRROR_USERNAME",
+			ValueFrom: secretKeyRef("username"),
+		},
+		{
+			Name:      "CONTRAST_MIRROR_PASSWORD",
+			ValueFrom: secretKeyRef("password"),
+		},
+	}
+}
+
+func templateFuncs(existingEnvVars []corev1.EnvVar, annotations map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"upper":   strings.ToUpper,
+		"lower":   strings.ToLower,
+		"replace": strings.ReplaceAll,
+		"env": func(name string) string {
+			return envVarValue(existingEnvVars, name)
+		},
+		"appendEnv": func(name, value, separator string) string {
+			return appendEnvVarValue(existingEnvVars, name, value, separator)
+		},
+		"annotation": func(key string) string {
+			return annotations[key]
+		},
+	}
+}
+
+func renderTemplate(text string, data agentTemplateData, funcs template.FuncMap) (string, error) {
+	tmpl, err := template.New("").Funcs(funcs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// appendEnvVarValue appends value to the value of the named env var if the container already sets it,
+// so flags the container relies on are kept. Values already containing value are left unchanged, so injecting
+// a container that was already injected doesn't repeat the flag.
+func appendEnvVarValue(existingEnvVars []corev1.EnvVar, name, value, separator string) string {
+	existing := envVarValue(existingEnvVars, name)
+	if len(existing) == 0 {
+		return value
+	}
+	if strings.Contains(existing, value) {
+		return existing
+	}
+	return existing + separator + value
+}
+
+// envVarValue returns the literal value of the named env var, or an empty string if the container doesn't set it
+func envVarValue(existingEnvVars []corev1.EnvVar, name string) string {
+	for _, envVar := range existingEnvVars {
+		if envVar.Name == name {
+			return envVar.Value
+		}
+	}
+	return ""
+}
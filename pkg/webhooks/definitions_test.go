@@ -0,0 +1,362 @@
+package webhooks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestLoadAgentRegistryDefaults(t *testing.T) {
+	registry, err := LoadAgentRegistry("")
+	assert.NoError(t, err)
+
+	for _, language := range []string{"java", "dotnet-core", "node", "python", "ruby"} {
+		assert.Contains(t, registry, language)
+	}
+}
+
+func TestLoadAgentRegistryFromFile(t *testing.T) {
+	agentsConfig := `
+agents:
+- language: Java
+  initContainer:
+    image: busybox:1.34.0
+    command: ["/bin/sh", "-c"]
+    args:
+    - wget -q -O /opt/contrast/contrast.jar "https://artifacts.example.com/contrast-agent-{{ .Version }}.jar"
+  env:
+  - name: JAVA_TOOL_OPTIONS
+    value: -javaagent:/opt/contrast/contrast.jar
+  - name: CONTRAST__APPLICATION__NAME
+    value: "{{ .ContainerName }}"
+- language: php
+  initContainer:
+    image: contrast/agent-php:{{ .Version }}
+`
+	path := filepath.Join(t.TempDir(), "agents.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(agentsConfig), 0600))
+
+	registry, err := LoadAgentRegistry(path)
+	assert.NoError(t, err)
+	assert.Contains(t, registry, "php")
+	assert.Contains(t, registry, "node")
+
+	initContainer, envVars, err := registry["java"].render(agentTemplateData{Version: "3.8.7.21531", ContainerName: "webgoat"}, nil, nil, DeliveryDownload)
+	assert.NoError(t, err)
+	assert.Equal(t, `wget -q -O /opt/contrast/contrast.jar "https://artifacts.example.com/contrast-agent-3.8.7.21531.jar"`, initContainer.Args[0])
+	assert.Equal(t, corev1.EnvVar{Name: "CONTRAST__APPLICATION__NAME", Value: "webgoat"}, envVars[1])
+}
+
+func TestLoadAgentRegistryErrors(t *testing.T) {
+	tt := []struct {
+		name         string
+		agentsConfig string
+	}{
+		{
+			name: "missing language",
+			agentsConfig: `
+agents:
+- initContainer:
+    image: busybox:1.34.0
+`,
+		},
+		{
+			name: "missing image",
+			agentsConfig: `
+agents:
+- language: java
+`,
+		},
+		{
+			name: "invalid template",
+			agentsConfig: `
+agents:
+- language: java
+  initContainer:
+    image: busybox:1.34.0
+    args:
+    - "{{ .Version"
+`,
+		},
+		{
+			name: "unknown template field",
+			agentsConfig: `
+agents:
+- language: java
+  initContainer:
+    image: busybox:1.34.0
+  env:
+  - name: CONTRAST__APPLICATION__NAME
+    value: "{{ .AppName }}"
+`,
+		},
+		{
+			name: "unknown field",
+			agentsConfig: `
+agents:
+- language: java
+  image: busybox:1.34.0
+`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "agents.yaml")
+			assert.NoError(t, ioutil.WriteFile(path, []byte(tc.agentsConfig), 0600))
+
+			_, err := LoadAgentRegistry(path)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadAgentRegistryMissingFile(t *testing.T) {
+	_, err := LoadAgentRegistry(filepath.Join(os.TempDir(), "does-not-exist.yaml"))
+	assert.Error(t, err)
+}
+
+func TestLoadAgentRegistryArtifactMirror(t *testing.T) {
+	agentsConfig := `
+artifactMirrors:
+  java:
+    url: https://nexus.example.com/repository/maven-central/{{ replace .Group "." "/" }}/{{ .Artifact }}/{{ .Version }}/{{ .Artifact }}-{{ .Version }}.jar
+    credentialsSecret: nexus-credentials
+`
+	path := filepath.Join(t.TempDir(), "agents.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(agentsConfig), 0600))
+
+	registry, err := LoadAgentRegistry(path)
+	assert.NoError(t, err)
+
+	initContainer, _, err := registry["java"].render(agentTemplateData{Version: "3.8.7.21531", ContainerName: "webgoat"}, nil, nil, DeliveryDownload)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://nexus.example.com/repository/maven-central/com/contrastsecurity/contrast-agent/3.8.7.21531/contrast-agent-3.8.7.21531.jar", initContainer.Args[1])
+	if assert.Equal(t, 5, len(initContainer.Env)) {
+		assert.Equal(t, "CONTRAST_AGENT_ARTIFACT_URL", initContainer.Env[2].Name)
+		assert.Equal(t, initContainer.Args[1], initContainer.Env[2].Value)
+		assert.Equal(t, "CONTRAST_MIRROR_USERNAME", initContainer.Env[3].Name)
+		assert.Empty(t, initContainer.Env[3].Value)
+		assert.Equal(t, &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "nexus-credentials"},
+			Key:                  "password",
+		}, initContainer.Env[4].ValueFrom.SecretKeyRef)
+	}
+
+	// The mirror only replaces the artifact of the language it is configured for
+	initContainer, _, err = registry["dotnet-core"].render(agentTemplateData{Version: "2.1.12"}, nil, nil, DeliveryDownload)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.nuget.org/api/v2/package/Contrast.SensorsNetCore/2.1.12", initContainer.Args[1])
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "CONTRAST_AGENT_VERSION", Value: "2.1.12"},
+		{Name: "CONTRAST_AGENT_ARTIFACT", Value: "Contrast.SensorsNetCore"},
+		{Name: "CONTRAST_AGENT_ARTIFACT_URL", Value: "https://www.nuget.org/api/v2/package/Contrast.SensorsNetCore/2.1.12"},
+	}, initContainer.Env)
+
+	// Credentials are only needed when the agent is downloaded
+	initContainer, _, err = registry["java"].render(agentTemplateData{Version: "3.8.7.21531"}, nil, nil, DeliveryImage)
+	assert.NoError(t, err)
+	assert.Empty(t, initContainer.Env)
+}
+
+func TestLoadAgentRegistryArtifactMirrorErrors(t *testing.T) {
+	tt := []struct {
+		name         string
+		agentsConfig string
+	}{
+		{
+			name: "relative url",
+			agentsConfig: `
+artifactMirrors:
+  java:
+    url: nexus.example.com/{{ .Artifact }}-{{ .Version }}.jar
+`,
+		},
+		{
+			name: "invalid template",
+			agentsConfig: `
+artifactMirrors:
+  java:
+    url: https://nexus.example.com/{{ .Artifact }-{{ .Version }}.jar
+`,
+		},
+		{
+			name: "unknown template field",
+			agentsConfig: `
+artifactMirrors:
+  java:
+    url: https://nexus.example.com/{{ .ArtifactId }}-{{ .Version }}.jar
+`,
+		},
+		{
+			name: "invalid credentials secret",
+			agentsConfig: `
+artifactMirrors:
+  java:
+    url: https://nexus.example.com/{{ .Artifact }}-{{ .Version }}.jar
+    credentialsSecret: Nexus_Credentials
+`,
+		},
+		{
+			name: "credentials secret for a package registry",
+			agentsConfig: `
+artifactMirrors:
+  node:
+    url: https://nexus.example.com/repository/npm/
+    credentialsSecret: nexus-credentials
+`,
+		},
+		{
+			name: "relative metadata url",
+			agentsConfig: `
+artifactMirrors:
+  java:
+    url: https://nexus.example.com/{{ .Artifact }}-{{ .Version }}.jar
+    metadataUrl: nexus.example.com/{{ .Artifact }}/maven-metadata.xml
+`,
+		},
+		{
+			name: "unknown language",
+			agentsConfig: `
+artifactMirrors:
+  php:
+    url: https://nexus.example.com/{{ .Artifact }}-{{ .Version }}.tgz
+`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "agents.yaml")
+			assert.NoError(t, ioutil.WriteFile(path, []byte(tc.agentsConfig), 0600))
+
+			_, err := LoadAgentRegistry(path)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadAgentRegistryArtifactMirrorSignature(t *testing.T) {
+	agentsConfig := `
+artifactMirrors:
+  java:
+    url: https://nexus.example.com/{{ .Artifact }}-{{ .Version }}.jar
+    credentialsSecret: nexus-credentials
+verification:
+  java:
+    signature:
+      url: "{{ .ArtifactURL }}.asc"
+      publicKey: not a key
+`
+	path := filepath.Join(t.TempDir(), "agents.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(agentsConfig), 0600))
+
+	_, err := LoadAgentRegistry(path)
+	assert.EqualError(t, err, "verification for java is invalid: agent definition for java is invalid: artifact signature can't be verified with the credentials secret nexus-credentials, the injector downloads the agent and its signature without credentials, pin checksums instead")
+
+	// Pinned checksums are verified by the init container, which has the credentials
+	agentsConfig = `
+artifactMirrors:
+  java:
+    url: https://nexus.example.com/{{ .Artifact }}-{{ .Version }}.jar
+    credentialsSecret: nexus-credentials
+verification:
+  java:
+    checksums:
+      3.8.7.21531: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+`
+	assert.NoError(t, ioutil.WriteFile(path, []byte(agentsConfig), 0600))
+	_, err = LoadAgentRegistry(path)
+	assert.NoError(t, err)
+}
+
+func TestLoadAgentRegistryVersionPolicy(t *testing.T) {
+	agentsConfig := `
+versionPolicies:
+  java:
+    allowed: ["3.x"]
+    denied: ["3.9.1.24000"]
+    action: rewrite
+    defaultVersion: 3.8.7.21531
+`
+	path := filepath.Join(t.TempDir(), "agents.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(agentsConfig), 0600))
+
+	registry, err := LoadAgentRegistry(path)
+	assert.NoError(t, err)
+	assert.Equal(t, &VersionPolicy{
+		Allowed:        []string{"3.x"},
+		Denied:         []string{"3.9.1.24000"},
+		Action:         VersionPolicyRewrite,
+		DefaultVersion: "3.8.7.21531",
+	}, registry["java"].VersionPolicy)
+	assert.Nil(t, registry["node"].VersionPolicy)
+
+	tt := []struct {
+		name         string
+		agentsConfig string
+		err          string
+	}{
+		{
+			name: "unknown action",
+			agentsConfig: `
+versionPolicies:
+  java:
+    action: ignore
+`,
+			err: "version policy for java is invalid: agent definition for java is invalid: action must be skip or rewrite",
+		},
+		{
+			name: "rewrite without default version",
+			agentsConfig: `
+versionPolicies:
+  java:
+    minimum: 3.8.0
+    action: rewrite
+`,
+			err: "version policy for java is invalid: agent definition for java is invalid: defaultVersion is required with the rewrite action",
+		},
+		{
+			name: "denied default version",
+			agentsConfig: `
+versionPolicies:
+  java:
+    denied: ["3.9.1.24000"]
+    action: rewrite
+    defaultVersion: 3.9.1.24000
+`,
+			err: "version policy for java is invalid: agent definition for java is invalid: defaultVersion 3.9.1.24000 is denied",
+		},
+		{
+			name: "minimum range",
+			agentsConfig: `
+versionPolicies:
+  java:
+    minimum: 3.x
+`,
+			err: "version policy for java is invalid: agent definition for java is invalid: minimum 3.x must be a concrete version",
+		},
+		{
+			name: "unknown language",
+			agentsConfig: `
+versionPolicies:
+  php:
+    minimum: 1.0.0
+`,
+			err: "version policy for php is invalid: no agent is defined for php",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "agents.yaml")
+			assert.NoError(t, ioutil.WriteFile(path, []byte(tc.agentsConfig), 0600))
+
+			_, err := LoadAgentRegistry(path)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package webhooks
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const autoLanguage = `auto`
+
+// DetectionRules are used to infer the language of a container when the language annotation is
+// missing or set to auto. Images and commands are regular expressions, matched against the
+// container image and its command and args joined with spaces, env contains env var names.
+type DetectionRules struct {
+	Images   []string `json:"images,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+	Env      []string `json:"env,omitempty"`
+
+	images   []*regexp.Regexp
+	commands []*regexp.Regexp
+}
+
+func (rules *DetectionRules) compile() error {
+	rules.images = nil
+	rules.commands = nil
+	for _, pattern := range rules.Images {
+		image, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid image pattern %v: %v", pattern, err)
+		}
+		rules.images = append(rules.images, image)
+	}
+	for _, pattern := range rules.Commands {
+		command, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid command pattern %v: %v", pattern, err)
+		}
+		rules.commands = append(rules.commands, command)
+	}
+	return nil
+}
+
+// detectLanguage infers the language of container from the detection rules of the registered agents.
+// The image is the strongest signal, so every agent's image rules are tried before the command rules,
+// which are tried before the env rules. Languages are checked in alphabetical order within each kind of rule.
+func (agents AgentRegistry) detectLanguage(container corev1.Container) (string, error) {
+	var languages []string
+	for language := range agents {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+
+	for _, language := range languages {
+		for _, image := range agents[language].Detect.images {
+			if image.MatchString(container.Image) {
+				log.Infof("Detected language %v for container %v: image %v matches %v", language, container.Name, container.Image, image)
+				return language, nil
+			}
+		}
+	}
+
+	command := strings.Join(append(append([]string{}, container.Command...), container.Args...), " ")
+	if len(command) != 0 {
+		for _, language := range languages {
+			for _, pattern := range agents[language].Detect.commands {
+				if pattern.MatchString(command) {
+					log.Infof("Detected language %v for container %v: command %q matches %v", language, container.Name, command, pattern)
+					return language, nil
+				}
+			}
+		}
+	}
+
+	for _, language := range languages {
+		for _, name := range agents[language].Detect.Env {
+			for _, envVar := range container.Env {
+				if envVar.Name == name {
+					log.Infof("Detected language %v for container %v: env var %v is set", language, container.Name, name)
+					return language, nil
+				}
+			}
+		}
+	}
+
+	return "", fmt.Errorf("could not detect the language of container %v, set the %v annotation", container.Name, injectorLanguageAnnotation)
+}
@@ -0,0 +1,85 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tt := []struct {
+		name      string
+		container corev1.Container
+		want      string
+	}{
+		{
+			name:      "java image",
+			container: corev1.Container{Name: "app", Image: "eclipse-temurin:17-jre"},
+			want:      "java",
+		},
+		{
+			name:      "dotnet image",
+			container: corev1.Container{Name: "app", Image: "mcr.microsoft.com/dotnet/aspnet:6.0"},
+			want:      "dotnet-core",
+		},
+		{
+			name:      "node image",
+			container: corev1.Container{Name: "app", Image: "docker.io/library/node:16-alpine"},
+			want:      "node",
+		},
+		{
+			name:      "java command",
+			container: corev1.Container{Name: "app", Image: "registry.example.com/orders", Command: []string{"java"}, Args: []string{"-jar", "/app/orders.jar"}},
+			want:      "java",
+		},
+		{
+			name:      "gunicorn command",
+			container: corev1.Container{Name: "app", Image: "registry.example.com/reports", Command: []string{"/usr/local/bin/gunicorn", "app:app"}},
+			want:      "python",
+		},
+		{
+			name:      "node command",
+			container: corev1.Container{Name: "app", Image: "registry.example.com/bff", Args: []string{"node", "server.js"}},
+			want:      "node",
+		},
+		{
+			name:      "java env",
+			container: corev1.Container{Name: "app", Image: "registry.example.com/billing", Env: []corev1.EnvVar{{Name: "JAVA_HOME", Value: "/opt/java"}}},
+			want:      "java",
+		},
+		{
+			name:      "image takes precedence over command",
+			container: corev1.Container{Name: "app", Image: "python:3.9-slim", Command: []string{"java", "-version"}},
+			want:      "python",
+		},
+	}
+
+	agents := DefaultAgentRegistry()
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			language, err := agents.detectLanguage(tc.container)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, language)
+		})
+	}
+}
+
+func TestDetectLanguageUnknown(t *testing.T) {
+	agents := DefaultAgentRegistry()
+	_, err := agents.detectLanguage(corev1.Container{Name: "app", Image: "registry.example.com/app", Command: []string{"/app"}})
+	assert.Error(t, err)
+}
+
+func TestLoadAgentRegistryInvalidDetectionRule(t *testing.T) {
+	_, err := parseAgentDefinitions([]byte(`
+agents:
+- language: java
+  initContainer:
+    image: busybox:1.34.0
+  detect:
+    images:
+    - "(openjdk"
+`), AgentRegistry{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,405 @@
+package webhooks
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// injectorInjectionPolicyAnnotation records the AgentInjectionPolicy applied to the Pod
+	injectorInjectionPolicyAnnotation = `contrast-agent-injector/injection-policy`
+)
+
+// The settings of an AgentInjectionPolicy that can be locked, annotations can't override locked settings
+const (
+	PolicySettingEnabled      = `enabled`
+	PolicySettingLanguage     = `language`
+	PolicySettingVersion      = `version`
+	PolicySettingContainers   = `containers`
+	PolicySettingConfig       = `config`
+	PolicySettingDeliveryMode = `deliveryMode`
+)
+
+// AgentInjectionPolicyResource is the cluster scoped AgentInjectionPolicy custom resource
+var AgentInjectionPolicyResource = schema.GroupVersionResource{
+	Group:    "injector.caseybuto.net",
+	Version:  "v1alpha1",
+	Resource: "agentinjectionpolicies",
+}
+
+// policySettingAnnotations are the annotations each lockable setting of a policy corresponds to, including their
+// per container variants
+var policySettingAnnotations = map[string][]string{
+	PolicySettingEnabled:      {injectorEnabledAnnotation},
+	PolicySettingLanguage:     {injectorLanguageAnnotation},
+	PolicySettingVersion:      {injectorVersionAnnotation},
+	PolicySettingContainers:   {injectorContainerAnnotation, injectorInjectAllAnnotation, injectorExcludeContainersAnnotation},
+	PolicySettingConfig:       {injectorConfigAnnotation, injectorConfigJSONAnnotation},
+	PolicySettingDeliveryMode: {injectorDeliveryAnnotation},
+}
+
+// AgentInjectionPolicy injects the agent into the Pods it selects, cluster wide. The settings of the policy are the
+// defaults of the Pods, their annotations and the annotations of their namespace override the settings that aren't
+// locked.
+type AgentInjectionPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AgentInjectionPolicySpec   `json:"spec"`
+	Status AgentInjectionPolicyStatus `json:"status,omitempty"`
+}
+
+// AgentInjectionPolicySpec is the injection configured by an AgentInjectionPolicy
+type AgentInjectionPolicySpec struct {
+	// Priority orders the policies selecting a Pod, only the policy with the highest priority is applied
+	Priority int32 `json:"priority,omitempty"`
+	// NamespaceSelector selects the namespaces of the Pods, every namespace when unset
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// PodSelector selects the Pods, every Pod when unset
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// Language is the language of the agent, detected from the containers when unset
+	Language string `json:"language,omitempty"`
+	// Version is the agent version, latest or a version range
+	Version string `json:"version,omitempty"`
+	// Containers are the containers the agent is injected into, the first container when unset
+	Containers *PolicyContainers `json:"containers,omitempty"`
+	// Config are the env vars configuring the agent
+	Config []PolicyEnvVar `json:"config,omitempty"`
+	// SecretName is the secret containing the contrast_security.yaml, the secret of the injector when unset
+	SecretName string `json:"secretName,omitempty"`
+	// DeliveryMode is how the agent is staged into the Pods, download or image
+	DeliveryMode string `json:"deliveryMode,omitempty"`
+	// Locked are the settings annotations can't override: enabled, language, version, containers, config and
+	// deliveryMode. Annotations can still add env vars to a locked config, but not change the env vars of the policy.
+	Locked []string `json:"locked,omitempty"`
+}
+
+// PolicyContainers are the containers an AgentInjectionPolicy injects the agent into, like the container,
+// inject-all and exclude-containers annotations
+type PolicyContainers struct {
+	Names     []string `json:"names,omitempty"`
+	InjectAll bool     `json:"injectAll,omitempty"`
+	Exclude   []string `json:"exclude,omitempty"`
+}
+
+// PolicyEnvVar is an env var configuring the agent
+type PolicyEnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// AgentInjectionPolicyStatus reports the Pods an AgentInjectionPolicy injected
+type AgentInjectionPolicyStatus struct {
+	// InjectedPods is the approximate number of Pod admissions the policy was applied to. It includes Pods rejected
+	// after the injector mutated them, and misses the counts of an injector replica that restarted before adding them.
+	InjectedPods int64 `json:"injectedPods,omitempty"`
+	// LastInjectionTime is the last time the policy was applied to a Pod admission
+	LastInjectionTime *metav1.Time `json:"lastInjectionTime,omitempty"`
+}
+
+// validate checks the settings of the policy the API server can't check
+func (policy *AgentInjectionPolicy) validate() error {
+	if _, err := selector(policy.Spec.NamespaceSelector); err != nil {
+		return fmt.Errorf("namespaceSelector is invalid: %v", err)
+	}
+	if _, err := selector(policy.Spec.PodSelector); err != nil {
+		return fmt.Errorf("podSelector is invalid: %v", err)
+	}
+	switch policy.Spec.DeliveryMode {
+	case "", DeliveryDownload, DeliveryImage:
+	default:
+		return fmt.Errorf("deliveryMode must be %v or %v", DeliveryDownload, DeliveryImage)
+	}
+	for _, envVar := range policy.Spec.Config {
+		if errs := validation.IsEnvVarName(envVar.Name); len(errs) != 0 {
+			return fmt.Errorf("config is invalid: %q is not a valid env var name", envVar.Name)
+		}
+	}
+	for _, setting := range policy.Spec.Locked {
+		if _, ok := policySettingAnnotations[setting]; !ok {
+			return fmt.Errorf("locked setting %v is unknown", setting)
+		}
+	}
+	return nil
+}
+
+// selector converts a label selector of a policy, an unset selector selects everything
+func selector(labelSelector *metav1.LabelSelector) (labels.Selector, error) {
+	if labelSelector == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(labelSelector)
+}
+
+// envVars returns the config of the policy as env vars
+func (policy *AgentInjectionPolicy) envVars() []corev1.EnvVar {
+	envVars := make([]corev1.EnvVar, 0, len(policy.Spec.Config))
+	for _, envVar := range policy.Spec.Config {
+		envVars = setEnvVar(envVars, envVar.Name, envVar.Value)
+	}
+	return envVars
+}
+
+// annotations returns the annotations the settings of the policy are equivalent to
+func (policy *AgentInjectionPolicy) annotations() (map[string]string, error) {
+	annotations := map[string]string{injectorEnabledAnnotation: "true"}
+	spec := policy.Spec
+	if len(spec.Language) != 0 {
+		annotations[injectorLanguageAnnotation] = spec.Language
+	}
+	if len(spec.Version) != 0 {
+		annotations[injectorVersionAnnotation] = spec.Version
+	}
+	if spec.Containers != nil {
+		if len(spec.Containers.Names) != 0 {
+			annotations[injectorContainerAnnotation] = strings.Join(spec.Containers.Names, ",")
+		}
+		if spec.Containers.InjectAll {
+			annotations[injectorInjectAllAnnotation] = "true"
+		}
+		if len(spec.Containers.Exclude) != 0 {
+			annotations[injectorExcludeContainersAnnotation] = strings.Join(spec.Containers.Exclude, ",")
+		}
+	}
+	if len(spec.Config) != 0 {
+		config, err := formatConfigAnnotation(policy.envVars())
+		if err != nil {
+			return nil, err
+		}
+		annotations[injectorConfigAnnotation] = config
+	}
+	if len(spec.DeliveryMode) != 0 {
+		annotations[injectorDeliveryAnnotation] = spec.DeliveryMode
+	}
+	return annotations, nil
+}
+
+// locked returns whether annotations can't override setting
+func (policy *AgentInjectionPolicy) locked(setting string) bool {
+	for _, locked := range policy.Spec.Locked {
+		if locked == setting {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns annotations with the settings of the policy as defaults, and the locked settings of the policy
+// replacing the annotations overriding them. warn reports the annotations that were ignored.
+func (policy *AgentInjectionPolicy) apply(annotations map[string]string, warn func(format string, args ...interface{})) (map[string]string, error) {
+	source := fmt.Sprintf("AgentInjectionPolicy %v", policy.Name)
+	defaults, err := policy.annotations()
+	if err != nil {
+		return nil, err
+	}
+	// defaults always enables the injection, so merged is a copy of annotations that can be changed
+	merged, err := withDefaults(source, defaults, annotations)
+	if err != nil {
+		return nil, err
+	}
+	if len(policy.Spec.Locked) == 0 {
+		return merged, nil
+	}
+
+	for _, setting := range policy.Spec.Locked {
+		if setting == PolicySettingConfig {
+			continue
+		}
+		for key, value := range merged {
+			if !settingAnnotation(setting, key) || value == defaults[key] {
+				continue
+			}
+			delete(merged, key)
+			warn("%v locks the %v setting, ignoring %v=%v", source, setting, key, value)
+		}
+		for _, annotation := range policySettingAnnotations[setting] {
+			if value, ok := defaults[annotation]; ok {
+				merged[annotation] = value
+			}
+		}
+	}
+
+	if policy.locked(PolicySettingConfig) && len(policy.Spec.Config) != 0 {
+		if err := policy.lockConfig(source, merged, warn); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+// lockConfig removes the env vars of the policy from the config annotations, and sets them in the config
+// annotation. Env vars the policy doesn't set can still be added by annotations.
+func (policy *AgentInjectionPolicy) lockConfig(source string, annotations map[string]string, warn func(format string, args ...interface{})) error {
+	envVars := policy.envVars()
+	lockedValues := map[string]string{}
+	for _, envVar := range envVars {
+		lockedValues[envVar.Name] = envVar.Value
+	}
+
+	for key, value := range annotations {
+		parse, format := parseConfigAnnotation, formatConfigAnnotation
+		switch strings.SplitN(key, ".", 2)[0] {
+		case injectorConfigAnnotation:
+		case injectorConfigJSONAnnotation:
+			parse, format = parseConfigJSONAnnotation, formatConfigJSONAnnotation
+		default:
+			continue
+		}
+		configEnvVars, err := parse(key, value)
+		if err != nil {
+			return err
+		}
+		var kept []corev1.EnvVar
+		for _, envVar := range configEnvVars {
+			if lockedValue, ok := lockedValues[envVar.Name]; ok {
+				if envVar.Value != lockedValue {
+					warn("%v locks the config env var %v, ignoring it in %v", source, envVar.Name, key)
+				}
+				continue
+			}
+			kept = append(kept, envVar)
+		}
+		if len(kept) == len(configEnvVars) {
+			continue
+		}
+		if len(kept) == 0 {
+			delete(annotations, key)
+			continue
+		}
+		if annotations[key], err = format(kept); err != nil {
+			return err
+		}
+	}
+
+	var config []corev1.EnvVar
+	if value, ok := annotations[injectorConfigAnnotation]; ok && len(value) != 0 {
+		var err error
+		if config, err = parseConfigAnnotation(injectorConfigAnnotation, value); err != nil {
+			return err
+		}
+	}
+	for _, envVar := range envVars {
+		config = setEnvVar(config, envVar.Name, envVar.Value)
+	}
+	var err error
+	annotations[injectorConfigAnnotation], err = formatConfigAnnotation(config)
+	return err
+}
+
+// settingAnnotation returns whether key is an annotation of setting, or one of its per container variants
+func settingAnnotation(setting, key string) bool {
+	for _, annotation := range policySettingAnnotations[setting] {
+		if key == annotation || strings.HasPrefix(key, annotation+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyLister lists AgentInjectionPolicies, usually from the cache of an informer
+type PolicyLister interface {
+	List() ([]*AgentInjectionPolicy, error)
+}
+
+// dynamicPolicyLister lists the AgentInjectionPolicies of the cache of a dynamic informer
+type dynamicPolicyLister struct {
+	lister cache.GenericLister
+}
+
+// NewDynamicPolicyLister returns a PolicyLister converting the unstructured AgentInjectionPolicies of lister,
+// e.g. the lister of a dynamic informer
+func NewDynamicPolicyLister(lister cache.GenericLister) PolicyLister {
+	return dynamicPolicyLister{lister: lister}
+}
+
+func (lister dynamicPolicyLister) List() ([]*AgentInjectionPolicy, error) {
+	objects, err := lister.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	policies := make([]*AgentInjectionPolicy, 0, len(objects))
+	for _, object := range objects {
+		content, ok := object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		policy := &AgentInjectionPolicy{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(content.UnstructuredContent(), policy); err != nil {
+			log.WithError(err).Warnf("Ignoring AgentInjectionPolicy %v", content.GetName())
+			continue
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// InjectionPolicies selects the AgentInjectionPolicy applied to a Pod
+type InjectionPolicies struct {
+	policies   PolicyLister
+	namespaces NamespaceLister
+}
+
+// NewInjectionPolicies returns the InjectionPolicies of policies, the labels of namespaces are looked up in namespaces
+func NewInjectionPolicies(policies PolicyLister, namespaces NamespaceLister) *InjectionPolicies {
+	return &InjectionPolicies{
+		policies:   policies,
+		namespaces: namespaces,
+	}
+}
+
+// match returns the policy with the highest priority selecting the Pod, policies with the same priority are ordered
+// by name. It is nil when no policy selects the Pod. Invalid policies are ignored.
+func (injectionPolicies *InjectionPolicies) match(namespace string, pod corev1.Pod) (*AgentInjectionPolicy, error) {
+	policies, err := injectionPolicies.policies.List()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the AgentInjectionPolicies: %v", err)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Spec.Priority != policies[j].Spec.Priority {
+			return policies[i].Spec.Priority > policies[j].Spec.Priority
+		}
+		return policies[i].Name < policies[j].Name
+	})
+
+	var namespaceLabels labels.Set
+	namespaceFound := false
+	if injectionPolicies.namespaces != nil && len(namespace) != 0 {
+		ns, err := injectionPolicies.namespaces.Get(namespace)
+		if err != nil {
+			log.WithError(err).Warnf("Could not get the labels of namespace %v, only AgentInjectionPolicies without a namespaceSelector apply", namespace)
+		} else {
+			namespaceLabels = ns.Labels
+			namespaceFound = true
+		}
+	}
+
+	for _, policy := range policies {
+		if err := policy.validate(); err != nil {
+			log.WithError(err).Warnf("Ignoring invalid AgentInjectionPolicy %v", policy.Name)
+			continue
+		}
+		if policy.Spec.NamespaceSelector != nil {
+			namespaceSelector, _ := selector(policy.Spec.NamespaceSelector)
+			if !namespaceFound || !namespaceSelector.Matches(namespaceLabels) {
+				continue
+			}
+		}
+		podSelector, _ := selector(policy.Spec.PodSelector)
+		if !podSelector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		return policy, nil
+	}
+	return nil, nil
+}
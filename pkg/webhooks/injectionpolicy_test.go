@@ -0,0 +1,263 @@
+package webhooks
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admission "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+// policyLister is a fake PolicyLister
+type policyLister []*AgentInjectionPolicy
+
+func (lister policyLister) List() ([]*AgentInjectionPolicy, error) {
+	// The cache of an informer is in no particular order
+	policies := make([]*AgentInjectionPolicy, len(lister))
+	copy(policies, lister)
+	return policies, nil
+}
+
+func injectionPolicy(name string, priority int32, spec AgentInjectionPolicySpec) *AgentInjectionPolicy {
+	spec.Priority = priority
+	return &AgentInjectionPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+}
+
+func TestInjectionPolicyMatch(t *testing.T) {
+	namespaces := namespaceLister{
+		"team-a": &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}},
+		"team-b": &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"team": "b"}}},
+	}
+	teamA := &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}
+	policies := NewInjectionPolicies(policyLister{
+		injectionPolicy("cluster", 0, AgentInjectionPolicySpec{}),
+		injectionPolicy("team-a-web", 10, AgentInjectionPolicySpec{
+			NamespaceSelector: teamA,
+			PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		}),
+		injectionPolicy("team-a", 10, AgentInjectionPolicySpec{NamespaceSelector: teamA}),
+		injectionPolicy("invalid", 100, AgentInjectionPolicySpec{DeliveryMode: "carrier-pigeon"}),
+		injectionPolicy("invalid-selector", 100, AgentInjectionPolicySpec{PodSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Near"}},
+		}}),
+	}, namespaces)
+
+	tests := []struct {
+		namespace string
+		labels    map[string]string
+		expected  string
+	}{
+		// Policies with the same priority are ordered by name
+		{"team-a", map[string]string{"app": "web"}, "team-a"},
+		{"team-a", map[string]string{"app": "api"}, "team-a"},
+		{"team-b", map[string]string{"app": "web"}, "cluster"},
+		// Policies selecting namespaces don't apply when the namespace can't be found
+		{"missing", nil, "cluster"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v %v", test.namespace, test.labels), func(t *testing.T) {
+			policy, err := policies.match(test.namespace, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: test.labels}})
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, policy.Name)
+		})
+	}
+
+	policies = NewInjectionPolicies(policyLister{injectionPolicy("team-a", 0, AgentInjectionPolicySpec{NamespaceSelector: teamA})}, namespaces)
+	policy, err := policies.match("team-b", corev1.Pod{})
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+}
+
+func TestInjectionPolicyApply(t *testing.T) {
+	policy := injectionPolicy("payments", 0, AgentInjectionPolicySpec{
+		Language:     "java",
+		Version:      "3.8.7.21531",
+		Containers:   &PolicyContainers{InjectAll: true, Exclude: []string{"log-shipper"}},
+		Config:       []PolicyEnvVar{{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "prod"}, {Name: "CONTRAST__APPLICATION__TAGS", Value: "payments"}},
+		DeliveryMode: DeliveryImage,
+	})
+	annotations := map[string]string{
+		injectorVersionAnnotation:                                      "3.9.1.24000",
+		containerAnnotation(injectorVersionAnnotation, "webgoat"):      "3.9.0.23000",
+		injectorConfigAnnotation:                                       "CONTRAST__SERVER__ENVIRONMENT=qa, CONTRAST__SERVER__NAME=webgoat",
+		containerAnnotation(injectorConfigJSONAnnotation, "webgoat"):   `{"CONTRAST__APPLICATION__TAGS": "webgoat"}`,
+		containerAnnotation(injectorLanguageAnnotation, "log-shipper"): "python",
+	}
+	var warnings []string
+	warn := func(format string, args ...interface{}) { warnings = append(warnings, fmt.Sprintf(format, args...)) }
+
+	// The annotations override the settings of the policy
+	applied, err := policy.apply(annotations, warn)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		injectorEnabledAnnotation:                                      "true",
+		injectorLanguageAnnotation:                                     "java",
+		injectorVersionAnnotation:                                      "3.9.1.24000",
+		containerAnnotation(injectorVersionAnnotation, "webgoat"):      "3.9.0.23000",
+		injectorInjectAllAnnotation:                                    "true",
+		injectorExcludeContainersAnnotation:                            "log-shipper",
+		injectorConfigAnnotation:                                       `CONTRAST__SERVER__ENVIRONMENT="qa", CONTRAST__APPLICATION__TAGS="payments", CONTRAST__SERVER__NAME="webgoat"`,
+		containerAnnotation(injectorConfigJSONAnnotation, "webgoat"):   `{"CONTRAST__APPLICATION__TAGS": "webgoat"}`,
+		containerAnnotation(injectorLanguageAnnotation, "log-shipper"): "python",
+		injectorDeliveryAnnotation:                                     DeliveryImage,
+	}, applied)
+	assert.Empty(t, warnings)
+
+	// Locked settings replace the annotations, the config keeps the env vars the policy doesn't set
+	policy.Spec.Locked = []string{PolicySettingVersion, PolicySettingConfig, PolicySettingEnabled}
+	applied, err = policy.apply(map[string]string{
+		injectorEnabledAnnotation:                                    "false",
+		injectorVersionAnnotation:                                    "3.9.1.24000",
+		containerAnnotation(injectorVersionAnnotation, "webgoat"):    "3.9.0.23000",
+		injectorConfigAnnotation:                                     "CONTRAST__SERVER__ENVIRONMENT=qa, CONTRAST__SERVER__NAME=webgoat",
+		containerAnnotation(injectorConfigJSONAnnotation, "webgoat"): `{"CONTRAST__APPLICATION__TAGS": "webgoat"}`,
+	}, warn)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		injectorEnabledAnnotation:           "true",
+		injectorLanguageAnnotation:          "java",
+		injectorVersionAnnotation:           "3.8.7.21531",
+		injectorInjectAllAnnotation:         "true",
+		injectorExcludeContainersAnnotation: "log-shipper",
+		injectorConfigAnnotation:            `CONTRAST__SERVER__NAME="webgoat", CONTRAST__SERVER__ENVIRONMENT="prod", CONTRAST__APPLICATION__TAGS="payments"`,
+		injectorDeliveryAnnotation:          DeliveryImage,
+	}, applied)
+	assert.ElementsMatch(t, []string{
+		"AgentInjectionPolicy payments locks the enabled setting, ignoring contrast-agent-injector/enabled=false",
+		"AgentInjectionPolicy payments locks the version setting, ignoring contrast-agent-injector/version=3.9.1.24000",
+		"AgentInjectionPolicy payments locks the version setting, ignoring contrast-agent-injector/version.webgoat=3.9.0.23000",
+		"AgentInjectionPolicy payments locks the config env var CONTRAST__SERVER__ENVIRONMENT, ignoring it in contrast-agent-injector/config",
+		"AgentInjectionPolicy payments locks the config env var CONTRAST__APPLICATION__TAGS, ignoring it in contrast-agent-injector/config-json.webgoat",
+	}, warnings)
+
+	_, err = policy.apply(map[string]string{injectorConfigAnnotation: "CONTRAST"}, warn)
+	assert.EqualError(t, err, `contrast-agent-injector/config is invalid at character 9: expected = after "CONTRAST"`)
+}
+
+func TestInjectionPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     AgentInjectionPolicySpec
+		expected string
+	}{
+		{"valid", AgentInjectionPolicySpec{DeliveryMode: DeliveryDownload, Locked: []string{PolicySettingDeliveryMode}}, ""},
+		{"delivery mode", AgentInjectionPolicySpec{DeliveryMode: "sidecar"}, "deliveryMode must be download or image"},
+		{"config", AgentInjectionPolicySpec{Config: []PolicyEnvVar{{Name: "1CONTRAST"}}}, `config is invalid: "1CONTRAST" is not a valid env var name`},
+		{"locked", AgentInjectionPolicySpec{Locked: []string{"secretName"}}, "locked setting secretName is unknown"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := injectionPolicy(test.name, 0, test.spec).validate()
+			if len(test.expected) == 0 {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.expected)
+			}
+		})
+	}
+}
+
+func TestDynamicPolicyLister(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, indexer.Add(&unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "injector.caseybuto.net/v1alpha1",
+		"kind":       "AgentInjectionPolicy",
+		"metadata":   map[string]interface{}{"name": "payments"},
+		"spec": map[string]interface{}{
+			"priority":          int64(10),
+			"namespaceSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"team": "payments"}},
+			"version":           "3.x",
+			"config":            []interface{}{map[string]interface{}{"name": "CONTRAST__SERVER__ENVIRONMENT", "value": "prod"}},
+		},
+		"status": map[string]interface{}{"injectedPods": int64(3)},
+	}}))
+	assert.NoError(t, indexer.Add(&unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "invalid"},
+		"spec":     map[string]interface{}{"priority": "high"},
+	}}))
+
+	policies, err := NewDynamicPolicyLister(cache.NewGenericLister(indexer, AgentInjectionPolicyResource.GroupResource())).List()
+	assert.NoError(t, err)
+	assert.Len(t, policies, 1)
+	assert.Equal(t, "payments", policies[0].Name)
+	assert.Equal(t, AgentInjectionPolicySpec{
+		Priority:          10,
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+		Version:           "3.x",
+		Config:            []PolicyEnvVar{{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "prod"}},
+	}, policies[0].Spec)
+	assert.Equal(t, int64(3), policies[0].Status.InjectedPods)
+}
+
+func TestMutateInjectionPolicy(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  labels:
+    app: webgoat
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+	podJSON, err := yaml.YAMLToJSON([]byte(podYaml))
+	assert.NoError(t, err)
+
+	status := NewInjectionPolicyStatus(nil)
+	mutateConfig := &MutateConfig{
+		SecretName: "test",
+		InjectionPolicies: NewInjectionPolicies(policyLister{
+			injectionPolicy("webgoat", 0, AgentInjectionPolicySpec{
+				PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "webgoat"}},
+				Language:    "java",
+				Version:     "3.8.7.21531",
+				Config:      []PolicyEnvVar{{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "prod"}},
+				SecretName:  "contrast-payments",
+				Locked:      []string{PolicySettingConfig},
+			}),
+		}, nil),
+		InjectionPolicyStatus: status,
+	}
+	request := &admission.AdmissionRequest{
+		Resource:  podResource,
+		Namespace: "team-a",
+		Object:    runtime.RawExtension{Raw: podJSON},
+	}
+	patches, warnings, err := mutateConfig.mutate(request)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	pod, err := applyPatches(podJSON, patches)
+	assert.NoError(t, err)
+	assert.Len(t, pod.Spec.InitContainers, 1)
+	assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "prod"})
+	assert.Equal(t, "contrast-payments", pod.Spec.Volumes[1].Secret.SecretName)
+	assert.Equal(t, map[string]string{injectorInjectionPolicyAnnotation: "webgoat"}, pod.Annotations)
+	assert.Equal(t, map[string]int64{"webgoat": 1}, status.injected)
+
+	// The annotations of the Pod can't change the env vars of a locked config, dry runs aren't counted
+	dryRun := true
+	request.DryRun = &dryRun
+	request.Object.Raw = []byte(`{"metadata":{"name":"webgoat-pod","labels":{"app":"webgoat"},"annotations":{"contrast-agent-injector/config":"CONTRAST__SERVER__ENVIRONMENT=qa"}},"spec":{"containers":[{"name":"webgoat","image":"webgoat/webgoat-8.0"}]}}`)
+	patches, warnings, err = mutateConfig.mutate(request)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"AgentInjectionPolicy webgoat locks the config env var CONTRAST__SERVER__ENVIRONMENT, ignoring it in contrast-agent-injector/config"}, warnings)
+	pod, err = applyPatches(request.Object.Raw, patches)
+	assert.NoError(t, err)
+	assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "prod"})
+	assert.Equal(t, map[string]int64{"webgoat": 1}, status.injected)
+
+	// Pods the policy doesn't select aren't injected
+	request.DryRun = nil
+	request.Object.Raw = []byte(`{"metadata":{"name":"other-pod","labels":{"app":"other"}},"spec":{"containers":[{"name":"other","image":"other"}]}}`)
+	_, _, err = mutateConfig.mutate(request)
+	assert.EqualError(t, err, "Skipping mutation: contrast-agent-injector/enabled annotation not set to enabled or true")
+}
@@ -0,0 +1,101 @@
+package webhooks
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+// InjectionPolicyStatus counts the Pod admissions each AgentInjectionPolicy was applied to, and periodically adds the
+// counts to the status of the policies. Admissions aren't slowed down by updating the status, and replicas of the
+// injector add their own counts. The counts are approximate: a Pod is counted when it is mutated, even if another
+// admission controller rejects it afterwards, and the counts a replica hasn't added yet are lost when it restarts.
+type InjectionPolicyStatus struct {
+	client dynamic.Interface
+	now    func() time.Time
+
+	mutex sync.Mutex
+	// injected are the Pods injected by each policy since the status was last updated, and the last injection time
+	injected      map[string]int64
+	lastInjection map[string]time.Time
+}
+
+// NewInjectionPolicyStatus returns an InjectionPolicyStatus updating the status of the policies with client
+func NewInjectionPolicyStatus(client dynamic.Interface) *InjectionPolicyStatus {
+	return &InjectionPolicyStatus{
+		client:        client,
+		now:           time.Now,
+		injected:      map[string]int64{},
+		lastInjection: map[string]time.Time{},
+	}
+}
+
+// record counts a Pod the policy name was applied to
+func (status *InjectionPolicyStatus) record(name string) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	status.injected[name]++
+	status.lastInjection[name] = status.now()
+}
+
+// Run updates the status of the policies every interval until ctx is done
+func (status *InjectionPolicyStatus) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, status.flush, interval)
+}
+
+// flush adds the recorded counts to the status of the policies. The counts of policies that couldn't be updated
+// are added on the next flush, the counts of deleted policies are dropped.
+func (status *InjectionPolicyStatus) flush(ctx context.Context) {
+	status.mutex.Lock()
+	injected, lastInjection := status.injected, status.lastInjection
+	status.injected, status.lastInjection = map[string]int64{}, map[string]time.Time{}
+	status.mutex.Unlock()
+
+	for name, count := range injected {
+		err := status.update(ctx, name, count, lastInjection[name])
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Warnf("Could not update the status of AgentInjectionPolicy %v", name)
+			status.mutex.Lock()
+			status.injected[name] += count
+			if status.lastInjection[name].Before(lastInjection[name]) {
+				status.lastInjection[name] = lastInjection[name]
+			}
+			status.mutex.Unlock()
+		}
+	}
+}
+
+// update adds count to the injected Pods of the policy name
+func (status *InjectionPolicyStatus) update(ctx context.Context, name string, count int64, lastInjection time.Time) error {
+	policies := status.client.Resource(AgentInjectionPolicyResource)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		policy, err := policies.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		injectedPods, _, err := unstructured.NestedInt64(policy.Object, "status", "injectedPods")
+		if err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedField(policy.Object, injectedPods+count, "status", "injectedPods"); err != nil {
+			return err
+		}
+		timestamp := lastInjection.UTC().Format(time.RFC3339)
+		if err := unstructured.SetNestedField(policy.Object, timestamp, "status", "lastInjectionTime"); err != nil {
+			return err
+		}
+		_, err = policies.UpdateStatus(ctx, policy, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,48 @@
+package webhooks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestInjectionPolicyStatus(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "injector.caseybuto.net/v1alpha1",
+		"kind":       "AgentInjectionPolicy",
+		"metadata":   map[string]interface{}{"name": "payments"},
+		"spec":       map[string]interface{}{"version": "3.x"},
+		"status":     map[string]interface{}{"injectedPods": int64(2)},
+	}})
+	status := NewInjectionPolicyStatus(client)
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	status.now = func() time.Time { return now }
+
+	status.record("payments")
+	status.record("payments")
+	status.record("deleted")
+	status.flush(context.TODO())
+
+	policy, err := client.Resource(AgentInjectionPolicyResource).Get(context.TODO(), "payments", metav1.GetOptions{})
+	assert.NoError(t, err)
+	injectedPods, _, err := unstructured.NestedInt64(policy.Object, "status", "injectedPods")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), injectedPods)
+	lastInjectionTime, _, err := unstructured.NestedString(policy.Object, "status", "lastInjectionTime")
+	assert.NoError(t, err)
+	assert.Equal(t, "2021-09-01T12:00:00Z", lastInjectionTime)
+
+	// The counts of deleted policies are dropped, the counts are only added once
+	assert.Empty(t, status.injected)
+	status.flush(context.TODO())
+	policy, err = client.Resource(AgentInjectionPolicyResource).Get(context.TODO(), "payments", metav1.GetOptions{})
+	assert.NoError(t, err)
+	injectedPods, _, _ = unstructured.NestedInt64(policy.Object, "status", "injectedPods")
+	assert.Equal(t, int64(4), injectedPods)
+}
@@ -1,6 +1,7 @@
 package webhooks
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -28,7 +29,37 @@ var (
 
 // MutateConfig is a struct containing the configuration for the mutation process
 type MutateConfig struct {
-	SecretName string
+	SecretName   string
+	Agents       AgentRegistry
+	DeliveryMode string
+	Verifier     *ArtifactVerifier
+	Resolver     *VersionResolver
+	// ArtifactCacheURL is the URL of the injector's artifact cache as seen from Pods, e.g. the injector Service
+	ArtifactCacheURL string
+	// InjectorImage is the image of the injector, init containers download the agent with its fetch-agent command
+	InjectorImage string
+	// FailurePolicy is the default failure policy, open or closed, overridden by the failure-policy annotation
+	FailurePolicy string
+	// InitContainerResources are the default requests and limits of init containers, overridden by the resource annotations
+	InitContainerResources *corev1.ResourceRequirements
+	// InitContainerUser is the user init containers run as when the Pod doesn't set one
+	InitContainerUser int64
+	// Namespaces looks up the Pod Security level of namespaces, the mutated Pod must still pass it
+	Namespaces NamespaceLister
+	// NamespaceDefaults looks up the injector annotations of namespaces, the defaults of their Pods, if set
+	NamespaceDefaults NamespaceLister
+	// ImagePullSecrets are added to mutated Pods, e.g. for private agent or injector images
+	ImagePullSecrets []string
+	// PullSecretCopier copies the image pull secrets into the namespace of the Pod, if set
+	PullSecretCopier *PullSecretCopier
+	// AllowConfigAPIOverrides allows the config-yaml annotation to override the api settings of the secret
+	AllowConfigAPIOverrides bool
+	// ConfigMaps checks that the ConfigMaps referenced by the config-from annotation exist, if set
+	ConfigMaps ConfigMapLister
+	// InjectionPolicies selects the AgentInjectionPolicy applied to Pods, if set
+	InjectionPolicies *InjectionPolicies
+	// InjectionPolicyStatus counts the Pods each AgentInjectionPolicy was applied to, if set
+	InjectionPolicyStatus *InjectionPolicyStatus
 }
 
 // patchOperation is an operation of a JSON patch, see https://tools.ietf.org/html/rfc6902 .
@@ -76,7 +107,8 @@ func (mutateConfig *MutateConfig) MutateHandler(response http.ResponseWriter, re
 		},
 	}
 
-	patchOperations, err := mutateConfig.mutate(admissionReviewRequest.Request)
+	patchOperations, warnings, err := mutateConfig.mutate(admissionReviewRequest.Request)
+	admissionReviewResponse.Response.Warnings = warnings
 
 	if err != nil {
 		// Always allow pods to be created without the agent injected
@@ -106,40 +138,123 @@ func (mutateConfig *MutateConfig) MutateHandler(response http.ResponseWriter, re
 	}
 }
 
-func (mutateConfig *MutateConfig) mutate(request *admission.AdmissionRequest) ([]patchOperation, error) {
+// mutate returns the patches injecting the agent into the Pod, and the warnings explaining the decisions made about it
+func (mutateConfig *MutateConfig) mutate(request *admission.AdmissionRequest) ([]patchOperation, []string, error) {
 	if request.Resource != podResource {
 		log.Infof("expect resource to be %v, but got %v", podResource, request.Resource)
 
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	raw := request.Object.Raw
 	pod := corev1.Pod{}
 
 	if _, _, err := universalDeserializer.Decode(raw, nil, &pod); err != nil {
-		return nil, fmt.Errorf("could not deserialize pod object: %v", err)
+		return nil, nil, fmt.Errorf("could not deserialize pod object: %v", err)
 	}
 
 	if len(pod.Spec.Containers) == 0 {
 		log.Warn("No containers found in pod")
-		return nil, fmt.Errorf("No containers defined in the Pod")
+		return nil, nil, fmt.Errorf("No containers defined in the Pod")
+	}
+
+	// The patches are applied to the Pod as admitted, annotations inherited from the namespace are only used to inject it
+	podAnnotations := pod.Annotations
+	defaults := namespaceDefaults(mutateConfig.NamespaceDefaults, request.Namespace)
+	annotations, err := withDefaults("namespace "+request.Namespace, defaults, pod.Annotations)
+	if err != nil {
+		return nil, nil, err
+	}
+	pod.Annotations = annotations
+
+	// The AgentInjectionPolicy selecting the Pod provides the defaults of the namespace and the Pod, and the
+	// settings they can't override
+	var warnings []string
+	secretName := mutateConfig.SecretName
+	var policy *AgentInjectionPolicy
+	if mutateConfig.InjectionPolicies != nil {
+		policy, err = mutateConfig.InjectionPolicies.match(request.Namespace, pod)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if policy != nil {
+		pod.Annotations, err = policy.apply(pod.Annotations, func(format string, args ...interface{}) {
+			warning := fmt.Sprintf(format, args...)
+			log.Info(warning)
+			warnings = append(warnings, warning)
+		})
+		if err != nil {
+			return nil, warnings, err
+		}
+		if len(policy.Spec.SecretName) != 0 {
+			secretName = policy.Spec.SecretName
+		}
 	}
 
 	if ok, err := mutationRequired(pod.Annotations); !ok {
-		return nil, err
+		return nil, warnings, err
 	}
 
 	agentPatch := AgentPatch{
-		pod:        pod,
-		secretName: mutateConfig.SecretName,
+		pod:              pod,
+		secretName:       secretName,
+		agents:           mutateConfig.Agents,
+		deliveryMode:     mutateConfig.DeliveryMode,
+		verifier:         mutateConfig.Verifier,
+		resolver:         mutateConfig.Resolver,
+		artifactCacheURL: mutateConfig.ArtifactCacheURL,
+		injectorImage:    mutateConfig.InjectorImage,
+		failurePolicy:    mutateConfig.FailurePolicy,
+
+		initContainerResources:  mutateConfig.InitContainerResources,
+		initContainerUser:       mutateConfig.InitContainerUser,
+		allowConfigAPIOverrides: mutateConfig.AllowConfigAPIOverrides,
+		namespace:               request.Namespace,
+		configMaps:              mutateConfig.ConfigMaps,
+		warnings:                &warnings,
 	}
 
 	patches, err := agentPatch.GenerateAgentPatches()
 	if err != nil {
-		return nil, err
+		// The Pod asked for the agent and is created without it, the warning tells whoever created it
+		warnings = append(warnings, fmt.Sprintf("The agent was not injected: %v", err))
+		return nil, warnings, err
+	}
+
+	patches = append(patches, addImagePullSecrets(pod.Spec.ImagePullSecrets, mutateConfig.ImagePullSecrets, "/spec/imagePullSecrets")...)
+	if policy != nil {
+		patches = append(patches, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations/" + escapeJSONPointer(injectorInjectionPolicyAnnotation),
+			Value: policy.Name,
+		})
+	}
+	patches = addAnnotationsPatch(podAnnotations, patches)
+
+	patches, err = mutateConfig.enforcePodSecurity(request.Namespace, raw, pod, patches)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	// Dry runs must not have side effects, and the secrets the Pod already references belong to the team
+	dryRun := request.DryRun != nil && *request.DryRun
+	if mutateConfig.PullSecretCopier != nil && !dryRun {
+		for _, name := range mutateConfig.ImagePullSecrets {
+			if containsPullSecret(pod.Spec.ImagePullSecrets, name) {
+				continue
+			}
+			if err := mutateConfig.PullSecretCopier.copy(context.TODO(), request.Namespace, name); err != nil {
+				return nil, warnings, fmt.Errorf("Skipping mutation: %v", err)
+			}
+		}
+	}
+
+	if policy != nil && mutateConfig.InjectionPolicyStatus != nil && !dryRun {
+		mutateConfig.InjectionPolicyStatus.record(policy.Name)
 	}
 
-	return patches, nil
+	return patches, warnings, nil
 }
 
 func mutationRequired(annotations map[string]string) (bool, error) {
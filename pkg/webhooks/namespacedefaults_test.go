@@ -0,0 +1,125 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admission "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+func TestNamespaceDefaults(t *testing.T) {
+	namespaces := namespaceLister{
+		"team-a": &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name: "team-a",
+			Annotations: map[string]string{
+				injectorVersionAnnotation: "3.8.7.21531",
+				"example.com/owner":       "team-a",
+			},
+		}},
+	}
+	assert.Equal(t, map[string]string{injectorVersionAnnotation: "3.8.7.21531"}, namespaceDefaults(namespaces, "team-a"))
+	assert.Nil(t, namespaceDefaults(namespaces, "missing"))
+	assert.Nil(t, namespaceDefaults(nil, "team-a"))
+}
+
+func TestWithDefaults(t *testing.T) {
+	defaults := map[string]string{
+		injectorLanguageAnnotation:                               "java",
+		injectorVersionAnnotation:                                "3.8.7.21531",
+		injectorConfigAnnotation:                                 `CONTRAST__SERVER__ENVIRONMENT=qa, CONTRAST__APPLICATION__TAGS="team-a,payments"`,
+		injectorConfigJSONAnnotation:                             `{"CONTRAST__SERVER__NAME": "team-a"}`,
+		containerAnnotation(injectorConfigAnnotation, "webgoat"): "CONTRAST__APPLICATION__NAME=webgoat",
+	}
+	annotations, err := withDefaults("namespace team-a", defaults, map[string]string{
+		injectorEnabledAnnotation:    "true",
+		injectorVersionAnnotation:    "3.9.1.24000",
+		injectorConfigAnnotation:     `CONTRAST__SERVER__ENVIRONMENT=prod, CONTRAST__SERVER__TAGS="say \"hi\""`,
+		injectorConfigJSONAnnotation: `{"CONTRAST__AGENT__LOGGER__LEVEL": "DEBUG"}`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		injectorEnabledAnnotation:                                "true",
+		injectorLanguageAnnotation:                               "java",
+		injectorVersionAnnotation:                                "3.9.1.24000",
+		injectorConfigAnnotation:                                 `CONTRAST__SERVER__ENVIRONMENT="prod", CONTRAST__APPLICATION__TAGS="team-a,payments", CONTRAST__SERVER__TAGS="say \"hi\""`,
+		injectorConfigJSONAnnotation:                             `[{"name":"CONTRAST__SERVER__NAME","value":"team-a"},{"name":"CONTRAST__AGENT__LOGGER__LEVEL","value":"DEBUG"}]`,
+		containerAnnotation(injectorConfigAnnotation, "webgoat"): "CONTRAST__APPLICATION__NAME=webgoat",
+	}, annotations)
+
+	// The merged config parses to the env vars of the namespace overridden by the env vars of the Pod
+	envVars, err := parseConfigAnnotation(injectorConfigAnnotation, annotations[injectorConfigAnnotation])
+	assert.NoError(t, err)
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "prod"},
+		{Name: "CONTRAST__APPLICATION__TAGS", Value: "team-a,payments"},
+		{Name: "CONTRAST__SERVER__TAGS", Value: `say "hi"`},
+	}, envVars)
+
+	annotations, err = withDefaults("namespace team-a", nil, map[string]string{injectorEnabledAnnotation: "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{injectorEnabledAnnotation: "true"}, annotations)
+
+	_, err = withDefaults("namespace team-a", map[string]string{injectorConfigAnnotation: "CONTRAST"}, map[string]string{injectorConfigAnnotation: "A=b"})
+	assert.EqualError(t, err, `contrast-agent-injector/config of namespace team-a is invalid at character 9: expected = after "CONTRAST"`)
+}
+
+func TestMutateNamespaceDefaults(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+	namespaces := namespaceLister{
+		"team-a": &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name: "team-a",
+			Annotations: map[string]string{
+				injectorEnabledAnnotation:  "true",
+				injectorLanguageAnnotation: "java",
+				injectorVersionAnnotation:  "3.9.1.24000",
+				injectorConfigAnnotation:   "CONTRAST__SERVER__ENVIRONMENT=qa",
+			},
+		}},
+	}
+	podJSON, err := yaml.YAMLToJSON([]byte(podYaml))
+	assert.NoError(t, err)
+
+	agents := DefaultAgentRegistry()
+	java := agents["java"]
+	java.VersionPolicy = &VersionPolicy{Denied: []string{"3.9.x"}, Action: VersionPolicyRewrite, DefaultVersion: "3.8.7.21531"}
+	agents["java"] = java
+	mutateConfig := &MutateConfig{
+		SecretName:        "test",
+		Agents:            agents,
+		NamespaceDefaults: namespaces,
+	}
+	patches, _, err := mutateConfig.mutate(&admission.AdmissionRequest{
+		Resource:  podResource,
+		Namespace: "team-a",
+		Object:    runtime.RawExtension{Raw: podJSON},
+	})
+	assert.NoError(t, err)
+
+	// The Pod doesn't have annotations, they are added for the version the policy rewrote
+	pod, err := applyPatches(podJSON, patches)
+	assert.NoError(t, err)
+	assert.Len(t, pod.Spec.InitContainers, 1)
+	assert.Contains(t, pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "CONTRAST__SERVER__ENVIRONMENT", Value: "qa"})
+	assert.Equal(t, map[string]string{containerAnnotation(injectorResolvedVersionAnnotation, "webgoat"): "3.8.7.21531"}, pod.Annotations)
+
+	// The Pod opts out of the injection enabled for the namespace
+	_, _, err = mutateConfig.mutate(&admission.AdmissionRequest{
+		Resource:  podResource,
+		Namespace: "team-a",
+		Object:    runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"webgoat-pod","annotations":{"contrast-agent-injector/enabled":"false"}},"spec":{"containers":[{"name":"webgoat","image":"webgoat/webgoat-8.0"}]}}`)},
+	})
+	assert.EqualError(t, err, "Skipping mutation: contrast-agent-injector/enabled annotation not set to enabled or true")
+}
@@ -0,0 +1,283 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// podSecurityEnforceLabel is the namespace label Pod Security Admission rejects Pods with
+	podSecurityEnforceLabel = `pod-security.kubernetes.io/enforce`
+
+	podSecurityPrivileged = `privileged`
+	podSecurityBaseline   = `baseline`
+	podSecurityRestricted = `restricted`
+)
+
+// NamespaceLister gets namespaces, usually from the cache of a namespace informer
+type NamespaceLister interface {
+	Get(name string) (*corev1.Namespace, error)
+}
+
+var (
+	// baselineCapabilities are the capabilities the baseline Pod Security Standard allows containers to add
+	baselineCapabilities = map[corev1.Capability]bool{
+		"AUDIT_WRITE": true, "CHOWN": true, "DAC_OVERRIDE": true, "FOWNER": true, "FSETID": true, "KILL": true,
+		"MKNOD": true, "NET_BIND_SERVICE": true, "SETFCAP": true, "SETGID": true, "SETPCAP": true, "SETUID": true,
+		"SYS_CHROOT": true,
+	}
+	// restrictedCapabilities are the capabilities the restricted Pod Security Standard allows containers to add
+	restrictedCapabilities = map[corev1.Capability]bool{
+		"NET_BIND_SERVICE": true,
+	}
+)
+
+// podSecurityLevel returns the Pod Security Standard enforced in namespace, privileged when the namespace
+// isn't labelled or can't be found. Like Pod Security Admission, an unknown level is treated as restricted.
+func podSecurityLevel(namespaces NamespaceLister, namespace string) string {
+	if namespaces == nil || len(namespace) == 0 {
+		return podSecurityPrivileged
+	}
+	ns, err := namespaces.Get(namespace)
+	if err != nil {
+		log.WithError(err).Warnf("Could not get the Pod Security level of namespace %v", namespace)
+		return podSecurityPrivileged
+	}
+	switch level := ns.Labels[podSecurityEnforceLabel]; level {
+	case "", podSecurityPrivileged:
+		return podSecurityPrivileged
+	case podSecurityBaseline, podSecurityRestricted:
+		return level
+	default:
+		return podSecurityRestricted
+	}
+}
+
+// enforcePodSecurity checks that the Pod patched by patches still passes the Pod Security Standard of its namespace.
+// The security context of the injected init containers is adjusted to the level, when the patched Pod still
+// violates the level where the original Pod didn't an error explains why the agent isn't injected.
+func (mutateConfig *MutateConfig) enforcePodSecurity(namespace string, raw []byte, pod corev1.Pod, patches []patchOperation) ([]patchOperation, error) {
+	level := podSecurityLevel(mutateConfig.Namespaces, namespace)
+	if level == podSecurityPrivileged {
+		return patches, nil
+	}
+
+	for i, patch := range patches {
+		switch value := patch.Value.(type) {
+		case corev1.Container:
+			if strings.HasPrefix(patch.Path, "/spec/initContainers") {
+				conformInitContainer(&value, level)
+				patches[i].Value = value
+			}
+		case []corev1.Container:
+			if patch.Path == "/spec/initContainers" {
+				for j := range value {
+					conformInitContainer(&value[j], level)
+				}
+			}
+		}
+	}
+
+	patched, err := applyPatches(raw, patches)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]bool{}
+	for _, violation := range podSecurityViolations(pod, level) {
+		existing[violation] = true
+	}
+	var violations []string
+	for _, violation := range podSecurityViolations(patched, level) {
+		if !existing[violation] {
+			violations = append(violations, violation)
+		}
+	}
+	if len(violations) != 0 {
+		return nil, fmt.Errorf("Skipping mutation: injecting the Contrast agent would violate the %v Pod Security Standard of namespace %v: %v",
+			level, namespace, strings.Join(violations, "; "))
+	}
+	return patches, nil
+}
+
+// applyPatches returns the Pod raw is patched to
+func applyPatches(raw []byte, patches []patchOperation) (corev1.Pod, error) {
+	patched := corev1.Pod{}
+	patchBytes, err := json.Marshal(patches)
+	if err != nil {
+		return patched, err
+	}
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return patched, err
+	}
+	patchedBytes, err := patch.Apply(raw)
+	if err != nil {
+		return patched, fmt.Errorf("could not apply patches to the Pod: %v", err)
+	}
+	if err := json.Unmarshal(patchedBytes, &patched); err != nil {
+		return patched, err
+	}
+	return patched, nil
+}
+
+// conformInitContainer drops the privileges and host ports of an injected init container the level doesn't allow
+func conformInitContainer(container *corev1.Container, level string) {
+	for i := range container.Ports {
+		container.Ports[i].HostPort = 0
+	}
+	if container.SecurityContext == nil {
+		container.SecurityContext = &corev1.SecurityContext{}
+	}
+	securityContext := container.SecurityContext.DeepCopy()
+	securityContext.Privileged = nil
+	securityContext.ProcMount = nil
+	if securityContext.SeccompProfile != nil && securityContext.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+		securityContext.SeccompProfile = nil
+	}
+	if securityContext.Capabilities != nil {
+		securityContext.Capabilities.Add = allowedCapabilities(securityContext.Capabilities.Add, baselineCapabilities)
+	}
+
+	if level == podSecurityRestricted {
+		runAsNonRoot := true
+		allowPrivilegeEscalation := false
+		securityContext.RunAsNonRoot = &runAsNonRoot
+		securityContext.AllowPrivilegeEscalation = &allowPrivilegeEscalation
+		if securityContext.RunAsUser != nil && *securityContext.RunAsUser == 0 {
+			user := DefaultInitContainerUser
+			securityContext.RunAsUser = &user
+		}
+		if securityContext.SeccompProfile == nil {
+			securityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+		}
+		if securityContext.Capabilities == nil {
+			securityContext.Capabilities = &corev1.Capabilities{}
+		}
+		securityContext.Capabilities.Add = allowedCapabilities(securityContext.Capabilities.Add, restrictedCapabilities)
+		securityContext.Capabilities.Drop = []corev1.Capability{"ALL"}
+	}
+	container.SecurityContext = securityContext
+}
+
+func allowedCapabilities(capabilities []corev1.Capability, allowed map[corev1.Capability]bool) []corev1.Capability {
+	var result []corev1.Capability
+	for _, capability := range capabilities {
+		if allowed[capability] {
+			result = append(result, capability)
+		}
+	}
+	return result
+}
+
+// podSecurityViolations returns how the containers and volumes of pod violate the Pod Security Standard level.
+// The host namespaces, sysctls, SELinux and AppArmor controls aren't checked, the injector never changes them.
+func podSecurityViolations(pod corev1.Pod, level string) []string {
+	if level == podSecurityPrivileged {
+		return nil
+	}
+	restricted := level == podSecurityRestricted
+	podSecurityContext := pod.Spec.SecurityContext
+	if podSecurityContext == nil {
+		podSecurityContext = &corev1.PodSecurityContext{}
+	}
+
+	var violations []string
+	for _, volume := range pod.Spec.Volumes {
+		switch {
+		case volume.HostPath != nil:
+			violations = append(violations, fmt.Sprintf("volume %q must not be a hostPath", volume.Name))
+		case restricted && volume.ConfigMap == nil && volume.CSI == nil && volume.DownwardAPI == nil && volume.EmptyDir == nil &&
+			volume.Ephemeral == nil && volume.PersistentVolumeClaim == nil && volume.Projected == nil && volume.Secret == nil:
+			violations = append(violations, fmt.Sprintf("volume %q must be a configMap, csi, downwardAPI, emptyDir, ephemeral, persistentVolumeClaim, projected or secret", volume.Name))
+		}
+	}
+
+	if restricted && podSecurityContext.RunAsUser != nil && *podSecurityContext.RunAsUser == 0 {
+		violations = append(violations, "pod must not set runAsUser to 0")
+	}
+
+	check := func(kind string, container corev1.Container) {
+		name := fmt.Sprintf("%v %q", kind, container.Name)
+		securityContext := container.SecurityContext
+		if securityContext == nil {
+			securityContext = &corev1.SecurityContext{}
+		}
+
+		if securityContext.Privileged != nil && *securityContext.Privileged {
+			violations = append(violations, fmt.Sprintf("%v must not be privileged", name))
+		}
+		for _, port := range container.Ports {
+			if port.HostPort != 0 {
+				violations = append(violations, fmt.Sprintf("%v must not set hostPort", name))
+				break
+			}
+		}
+		if securityContext.ProcMount != nil && *securityContext.ProcMount != corev1.DefaultProcMount {
+			violations = append(violations, fmt.Sprintf("%v must use the default procMount", name))
+		}
+
+		allowed := baselineCapabilities
+		if restricted {
+			allowed = restrictedCapabilities
+		}
+		if securityContext.Capabilities != nil {
+			for _, capability := range securityContext.Capabilities.Add {
+				if !allowed[capability] {
+					violations = append(violations, fmt.Sprintf("%v must not add the %v capability", name, capability))
+				}
+			}
+		}
+
+		seccompProfile := podSecurityContext.SeccompProfile
+		if securityContext.SeccompProfile != nil {
+			seccompProfile = securityContext.SeccompProfile
+		}
+		if seccompProfile != nil && seccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+			violations = append(violations, fmt.Sprintf("%v must not use the Unconfined seccomp profile", name))
+		}
+
+		if !restricted {
+			return
+		}
+		if seccompProfile == nil {
+			violations = append(violations, fmt.Sprintf("%v must use the RuntimeDefault or Localhost seccomp profile", name))
+		}
+		if securityContext.AllowPrivilegeEscalation == nil || *securityContext.AllowPrivilegeEscalation {
+			violations = append(violations, fmt.Sprintf("%v must set allowPrivilegeEscalation to false", name))
+		}
+		runAsNonRoot := podSecurityContext.RunAsNonRoot
+		if securityContext.RunAsNonRoot != nil {
+			runAsNonRoot = securityContext.RunAsNonRoot
+		}
+		if runAsNonRoot == nil || !*runAsNonRoot {
+			violations = append(violations, fmt.Sprintf("%v must set runAsNonRoot to true", name))
+		}
+		if securityContext.RunAsUser != nil && *securityContext.RunAsUser == 0 {
+			violations = append(violations, fmt.Sprintf("%v must not set runAsUser to 0", name))
+		}
+		dropsAll := false
+		if securityContext.Capabilities != nil {
+			for _, capability := range securityContext.Capabilities.Drop {
+				if capability == "ALL" {
+					dropsAll = true
+				}
+			}
+		}
+		if !dropsAll {
+			violations = append(violations, fmt.Sprintf("%v must drop ALL capabilities", name))
+		}
+	}
+	for _, container := range pod.Spec.InitContainers {
+		check("init container", container)
+	}
+	for _, container := range pod.Spec.Containers {
+		check("container", container)
+	}
+	return violations
+}
@@ -0,0 +1,215 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admission "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+type namespaceLister map[string]*corev1.Namespace
+
+func (namespaces namespaceLister) Get(name string) (*corev1.Namespace, error) {
+	namespace, ok := namespaces[name]
+	if !ok {
+		return nil, fmt.Errorf("namespace %v not found", name)
+	}
+	return namespace, nil
+}
+
+func podSecurityNamespaces() namespaceLister {
+	namespaces := namespaceLister{}
+	for _, level := range []string{podSecurityPrivileged, podSecurityBaseline, podSecurityRestricted, "strict"} {
+		namespaces[level] = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   level,
+			Labels: map[string]string{podSecurityEnforceLabel: level},
+		}}
+	}
+	namespaces["unlabelled"] = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "unlabelled"}}
+	return namespaces
+}
+
+func TestPodSecurityLevel(t *testing.T) {
+	namespaces := podSecurityNamespaces()
+	assert.Equal(t, podSecurityPrivileged, podSecurityLevel(nil, "restricted"))
+	assert.Equal(t, podSecurityPrivileged, podSecurityLevel(namespaces, "unlabelled"))
+	assert.Equal(t, podSecurityPrivileged, podSecurityLevel(namespaces, "missing"))
+	assert.Equal(t, podSecurityBaseline, podSecurityLevel(namespaces, "baseline"))
+	assert.Equal(t, podSecurityRestricted, podSecurityLevel(namespaces, "restricted"))
+	assert.Equal(t, podSecurityRestricted, podSecurityLevel(namespaces, "strict"))
+}
+
+func TestMutatePodSecurity(t *testing.T) {
+	restrictedPod := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+spec:
+  securityContext:
+    runAsNonRoot: true
+    runAsUser: 1000
+    seccompProfile:
+      type: RuntimeDefault
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+    securityContext:
+      allowPrivilegeEscalation: false
+      capabilities:
+        drop: ["ALL"]
+`
+	baselinePod := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+spec:
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+
+	agents := DefaultAgentRegistry()
+	hostPathJava := agents["java"]
+	hostPathJava.Volumes = []corev1.Volume{{
+		Name:         "contrast-cache",
+		VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/var/cache/contrast"}},
+	}}
+	hostPathAgents := DefaultAgentRegistry()
+	hostPathAgents["java"] = hostPathJava
+
+	tests := []struct {
+		name      string
+		pod       string
+		namespace string
+		agents    AgentRegistry
+		message   string
+	}{
+		{name: "restricted", pod: restrictedPod, namespace: podSecurityRestricted},
+		{name: "baseline", pod: baselinePod, namespace: podSecurityBaseline},
+		{name: "unlabelled", pod: baselinePod, namespace: "unlabelled"},
+		// The baseline pod doesn't pass restricted, only the violations of the injected agent skip the injection
+		{name: "existing violations", pod: baselinePod, namespace: podSecurityRestricted},
+		{
+			name:      "host path volume",
+			pod:       baselinePod,
+			namespace: podSecurityBaseline,
+			agents:    hostPathAgents,
+			message:   `Skipping mutation: injecting the Contrast agent would violate the baseline Pod Security Standard of namespace baseline: volume "contrast-cache" must not be a hostPath`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			podJSON, err := yaml.YAMLToJSON([]byte(test.pod))
+			assert.NoError(t, err)
+
+			mutateConfig := &MutateConfig{
+				SecretName: "test",
+				Agents:     test.agents,
+				Namespaces: podSecurityNamespaces(),
+			}
+			patches, _, err := mutateConfig.mutate(&admission.AdmissionRequest{
+				Resource:  podResource,
+				Namespace: test.namespace,
+				Object:    runtime.RawExtension{Raw: podJSON},
+			})
+			if len(test.message) != 0 {
+				assert.EqualError(t, err, test.message)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotEmpty(t, patches)
+
+			original := corev1.Pod{}
+			assert.NoError(t, json.Unmarshal(podJSON, &original))
+			pod, err := applyPatches(podJSON, patches)
+			assert.NoError(t, err)
+			assert.Len(t, pod.Spec.InitContainers, 1)
+			level := podSecurityLevel(mutateConfig.Namespaces, test.namespace)
+			assert.Equal(t, podSecurityViolations(original, level), podSecurityViolations(pod, level))
+		})
+	}
+}
+
+func TestConformInitContainer(t *testing.T) {
+	privileged := true
+	container := corev1.Container{
+		Name:  "contrast-agent-injector",
+		Ports: []corev1.ContainerPort{{ContainerPort: 8080, HostPort: 8080}},
+		SecurityContext: &corev1.SecurityContext{
+			Privileged: &privileged,
+			Capabilities: &corev1.Capabilities{
+				Add: []corev1.Capability{"NET_ADMIN", "CHOWN", "NET_BIND_SERVICE"},
+			},
+		},
+	}
+
+	baseline := container
+	conformInitContainer(&baseline, podSecurityBaseline)
+	assert.Empty(t, podSecurityViolations(corev1.Pod{Spec: corev1.PodSpec{InitContainers: []corev1.Container{baseline}}}, podSecurityBaseline))
+	assert.Equal(t, []corev1.Capability{"CHOWN", "NET_BIND_SERVICE"}, baseline.SecurityContext.Capabilities.Add)
+
+	restricted := container
+	conformInitContainer(&restricted, podSecurityRestricted)
+	assert.Empty(t, podSecurityViolations(corev1.Pod{Spec: corev1.PodSpec{InitContainers: []corev1.Container{restricted}}}, podSecurityRestricted))
+	assert.Equal(t, []corev1.Capability{"NET_BIND_SERVICE"}, restricted.SecurityContext.Capabilities.Add)
+
+	// The original container isn't changed
+	assert.True(t, *container.SecurityContext.Privileged)
+}
+
+func TestPodSecurityViolations(t *testing.T) {
+	root := int64(0)
+	escalation := true
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			SecurityContext: &corev1.PodSecurityContext{
+				SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined},
+			},
+			Volumes: []corev1.Volume{
+				{Name: "agent", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+				{Name: "config", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "contrast"}}},
+				{Name: "nfs", VolumeSource: corev1.VolumeSource{NFS: &corev1.NFSVolumeSource{Server: "nfs", Path: "/"}}},
+			},
+			Containers: []corev1.Container{{
+				Name: "app",
+				SecurityContext: &corev1.SecurityContext{
+					RunAsUser:                &root,
+					AllowPrivilegeEscalation: &escalation,
+					Capabilities:             &corev1.Capabilities{Add: []corev1.Capability{"SYS_ADMIN"}},
+				},
+			}},
+		},
+	}
+
+	baseline := strings.Join(podSecurityViolations(pod, podSecurityBaseline), "\n")
+	assert.Equal(t, `container "app" must not add the SYS_ADMIN capability
+container "app" must not use the Unconfined seccomp profile`, baseline)
+
+	restricted := podSecurityViolations(pod, podSecurityRestricted)
+	assert.Contains(t, restricted, `volume "nfs" must be a configMap, csi, downwardAPI, emptyDir, ephemeral, persistentVolumeClaim, projected or secret`)
+	assert.Contains(t, restricted, `container "app" must set allowPrivilegeEscalation to false`)
+	assert.Contains(t, restricted, `container "app" must set runAsNonRoot to true`)
+	assert.Contains(t, restricted, `container "app" must not set runAsUser to 0`)
+	assert.Contains(t, restricted, `container "app" must drop ALL capabilities`)
+	assert.NotContains(t, strings.Join(restricted, "\n"), `"agent"`)
+	assert.NotContains(t, strings.Join(restricted, "\n"), `"config"`)
+
+	assert.Empty(t, podSecurityViolations(pod, podSecurityPrivileged))
+}
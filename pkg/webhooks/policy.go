@@ -0,0 +1,96 @@
+package webhooks
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// VersionPolicySkip creates Pods requesting a version the policy doesn't allow without the agent
+	VersionPolicySkip = `skip`
+	// VersionPolicyRewrite injects the default version of the policy into Pods requesting a version it doesn't allow
+	VersionPolicyRewrite = `rewrite`
+)
+
+// VersionPolicy restricts the agent versions Pods can request for a language. Allowed and denied versions are
+// concrete versions or version ranges such as 3.x or 3.8.*, the minimum is a concrete version.
+type VersionPolicy struct {
+	Allowed []string `json:"allowed,omitempty"`
+	Minimum string   `json:"minimum,omitempty"`
+	Denied  []string `json:"denied,omitempty"`
+	// Action is skip or rewrite, what happens to Pods requesting a version the policy doesn't allow
+	Action string `json:"action,omitempty"`
+	// DefaultVersion is the version injected instead of a version the policy doesn't allow with the rewrite action
+	DefaultVersion string `json:"defaultVersion,omitempty"`
+}
+
+func (policy VersionPolicy) validate() error {
+	switch policy.Action {
+	case "", VersionPolicySkip, VersionPolicyRewrite:
+	default:
+		return fmt.Errorf("action must be %v or %v", VersionPolicySkip, VersionPolicyRewrite)
+	}
+	for _, version := range append(append([]string{}, policy.Allowed...), policy.Denied...) {
+		if len(version) == 0 {
+			return fmt.Errorf("allowed and denied versions can't be empty")
+		}
+	}
+	if isVersionRange(policy.Minimum) {
+		return fmt.Errorf("minimum %v must be a concrete version", policy.Minimum)
+	}
+	if policy.Action == VersionPolicyRewrite && len(policy.DefaultVersion) == 0 {
+		return fmt.Errorf("defaultVersion is required with the %v action", VersionPolicyRewrite)
+	}
+	if len(policy.DefaultVersion) != 0 {
+		if err := validateVersion(policy.DefaultVersion); err != nil {
+			return fmt.Errorf("defaultVersion %v", err)
+		}
+		if isVersionRange(policy.DefaultVersion) {
+			return fmt.Errorf("defaultVersion %v must be a concrete version", policy.DefaultVersion)
+		}
+		if reason := policy.check(policy.DefaultVersion); len(reason) != 0 {
+			return fmt.Errorf("defaultVersion %v %v", policy.DefaultVersion, reason)
+		}
+	}
+	return nil
+}
+
+// check returns why the policy doesn't allow version, or an empty string when it does. Version ranges that
+// weren't resolved to a concrete version are only allowed by a policy without restrictions.
+func (policy *VersionPolicy) check(version string) string {
+	if policy == nil || (len(policy.Allowed) == 0 && len(policy.Minimum) == 0 && len(policy.Denied) == 0) {
+		return ""
+	}
+	for _, denied := range policy.Denied {
+		if matchVersion(denied, version) {
+			return "is denied"
+		}
+	}
+	if isVersionRange(version) {
+		return "is a version range that can't be checked against the version policy"
+	}
+	if len(policy.Minimum) != 0 && compareVersions(version, policy.Minimum) < 0 {
+		return fmt.Sprintf("is below the minimum version %v", policy.Minimum)
+	}
+	if len(policy.Allowed) == 0 {
+		return ""
+	}
+	for _, allowed := range policy.Allowed {
+		if matchVersion(allowed, version) {
+			return ""
+		}
+	}
+	return "isn't an allowed version"
+}
+
+// matchVersion returns true when version is pattern, or is in the version range pattern. latest only matches
+// a requested latest that wasn't resolved, it doesn't stand for every version.
+func matchVersion(pattern, version string) bool {
+	if !isVersionRange(pattern) {
+		return pattern == version
+	}
+	if strings.EqualFold(pattern, latestVersion) {
+		return strings.EqualFold(version, latestVersion)
+	}
+	return strings.HasPrefix(version, strings.TrimRight(pattern, "x*"))
+}
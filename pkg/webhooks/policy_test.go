@@ -0,0 +1,51 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionPolicyCheck(t *testing.T) {
+	policy := &VersionPolicy{
+		Allowed: []string{"3.x", "4.1.*", "4.2.0.30000"},
+		Minimum: "3.8.0",
+		Denied:  []string{"3.9.1.24000", "4.1.3.*"},
+	}
+
+	tests := []struct {
+		version string
+		reason  string
+	}{
+		{version: "3.8.7.21531"},
+		{version: "3.10.0.1"},
+		{version: "4.1.2.29000"},
+		{version: "4.2.0.30000"},
+		{version: "3.7.9.20000", reason: "is below the minimum version 3.8.0"},
+		{version: "3.9.1.24000", reason: "is denied"},
+		{version: "4.1.3.29500", reason: "is denied"},
+		{version: "4.2.1.30500", reason: "isn't an allowed version"},
+		{version: "5.0.0", reason: "isn't an allowed version"},
+		{version: "latest", reason: "is a version range that can't be checked against the version policy"},
+		{version: "4.1.3.x", reason: "is denied"},
+	}
+	for _, test := range tests {
+		t.Run(test.version, func(t *testing.T) {
+			assert.Equal(t, test.reason, policy.check(test.version))
+		})
+	}
+
+	// A denied latest only denies latest when it can't be resolved, not every version
+	latestPolicy := &VersionPolicy{Denied: []string{"latest"}}
+	assert.Empty(t, latestPolicy.check("3.8.7.21531"))
+	assert.Equal(t, "is denied", latestPolicy.check("latest"))
+	assert.Equal(t, "is denied", latestPolicy.check("LATEST"))
+	assert.True(t, matchVersion("latest", "latest"))
+	assert.False(t, matchVersion("latest", "4.2.0.30000"))
+	assert.False(t, matchVersion("latest", "3.x"))
+
+	// Without restrictions every version, including ranges, is allowed
+	var noPolicy *VersionPolicy
+	assert.Empty(t, noPolicy.check("latest"))
+	assert.Empty(t, (&VersionPolicy{Action: VersionPolicySkip}).check("3.x"))
+}
@@ -0,0 +1,122 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	managedByLabel = `app.kubernetes.io/managed-by`
+	managedByValue = `contrast-agent-injector`
+)
+
+// PullSecretCopier copies the image pull secrets added to Pods from the injector's namespace into the namespace
+// of the Pod, so teams don't need to know which registry credentials the init containers require
+type PullSecretCopier struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+// NewPullSecretCopier returns a PullSecretCopier copying secrets from namespace with client
+func NewPullSecretCopier(client kubernetes.Interface, namespace string) *PullSecretCopier {
+	return &PullSecretCopier{
+		client:    client,
+		namespace: namespace,
+	}
+}
+
+// copy creates or updates the secret name in namespace. Secrets that already exist in namespace and weren't
+// copied by the injector belong to the team and are left alone.
+func (copier *PullSecretCopier) copy(ctx context.Context, namespace, name string) error {
+	if namespace == copier.namespace {
+		return nil
+	}
+
+	source, err := copier.client.CoreV1().Secrets(copier.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get image pull secret %v/%v: %v", copier.namespace, name, err)
+	}
+
+	secrets := copier.client.CoreV1().Secrets(namespace)
+	existing, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		_, err = secrets.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    map[string]string{managedByLabel: managedByValue},
+			},
+			Type: source.Type,
+			Data: source.Data,
+		}, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			// Another replica copied the secret for a Pod admitted at the same time
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not copy image pull secret %v into %v: %v", name, namespace, err)
+		}
+		log.Infof("Copied image pull secret %v into namespace %v", name, namespace)
+		return nil
+	case err != nil:
+		return fmt.Errorf("could not get image pull secret %v/%v: %v", namespace, name, err)
+	case existing.Labels[managedByLabel] != managedByValue:
+		log.Infof("Image pull secret %v already exists in namespace %v, not copying it", name, namespace)
+		return nil
+	case existing.Type == source.Type && reflect.DeepEqual(existing.Data, source.Data):
+		return nil
+	}
+
+	// Rotated credentials are copied again
+	updated := existing.DeepCopy()
+	updated.Type = source.Type
+	updated.Data = source.Data
+	if _, err := secrets.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("could not update image pull secret %v in %v: %v", name, namespace, err)
+	}
+	log.Infof("Updated image pull secret %v in namespace %v", name, namespace)
+	return nil
+}
+
+func containsPullSecret(secrets []corev1.LocalObjectReference, name string) bool {
+	for _, secret := range secrets {
+		if secret.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addImagePullSecrets returns the patches adding the image pull secrets the Pod doesn't reference yet
+func addImagePullSecrets(existingSecrets []corev1.LocalObjectReference, secretsToAdd []string, basePath string) (patch []patchOperation) {
+	first := len(existingSecrets) == 0
+	var added []string
+	for _, name := range secretsToAdd {
+		if containsPullSecret(existingSecrets, name) || containsString(added, name) {
+			continue
+		}
+		added = append(added, name)
+
+		var value interface{} = corev1.LocalObjectReference{Name: name}
+		path := basePath + "/-"
+		if first {
+			first = false
+			value = []corev1.LocalObjectReference{{Name: name}}
+			path = basePath
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
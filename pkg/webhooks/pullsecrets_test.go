@@ -0,0 +1,126 @@
+package webhooks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admission "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func pullSecret(namespace string, labels map[string]string, auth string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "contrast-registry", Namespace: namespace, Labels: labels},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(auth)},
+	}
+}
+
+func TestPullSecretCopier(t *testing.T) {
+	managed := map[string]string{managedByLabel: managedByValue}
+	client := fake.NewSimpleClientset(
+		pullSecret("contrast", nil, `{"auths":{"registry.example.com":{"auth":"new"}}}`),
+		pullSecret("payments", nil, `{"auths":{"registry.example.com":{"auth":"team"}}}`),
+		pullSecret("orders", managed, `{"auths":{"registry.example.com":{"auth":"old"}}}`),
+	)
+	copier := NewPullSecretCopier(client, "contrast")
+	ctx := context.Background()
+	get := func(namespace string) string {
+		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, "contrast-registry", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return string(secret.Data[corev1.DockerConfigJsonKey])
+	}
+
+	// Missing secrets are copied
+	assert.NoError(t, copier.copy(ctx, "webgoat", "contrast-registry"))
+	assert.Equal(t, `{"auths":{"registry.example.com":{"auth":"new"}}}`, get("webgoat"))
+	secret, err := client.CoreV1().Secrets("webgoat").Get(ctx, "contrast-registry", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.SecretTypeDockerConfigJson, secret.Type)
+	assert.Equal(t, managed, secret.Labels)
+
+	// Secrets of the team are left alone
+	assert.NoError(t, copier.copy(ctx, "payments", "contrast-registry"))
+	assert.Equal(t, `{"auths":{"registry.example.com":{"auth":"team"}}}`, get("payments"))
+
+	// Copies of rotated secrets are updated
+	assert.NoError(t, copier.copy(ctx, "orders", "contrast-registry"))
+	assert.Equal(t, `{"auths":{"registry.example.com":{"auth":"new"}}}`, get("orders"))
+
+	assert.NoError(t, copier.copy(ctx, "contrast", "contrast-registry"))
+	assert.EqualError(t, copier.copy(ctx, "webgoat", "missing"), `could not get image pull secret contrast/missing: secrets "missing" not found`)
+}
+
+func TestAddImagePullSecrets(t *testing.T) {
+	assert.Equal(t, []patchOperation{
+		{Op: "add", Path: "/spec/imagePullSecrets", Value: []corev1.LocalObjectReference{{Name: "contrast-registry"}}},
+		{Op: "add", Path: "/spec/imagePullSecrets/-", Value: corev1.LocalObjectReference{Name: "ghcr"}},
+	}, addImagePullSecrets(nil, []string{"contrast-registry", "ghcr", "contrast-registry"}, "/spec/imagePullSecrets"))
+
+	// Secrets the Pod already references aren't duplicated
+	assert.Equal(t, []patchOperation{
+		{Op: "add", Path: "/spec/imagePullSecrets/-", Value: corev1.LocalObjectReference{Name: "ghcr"}},
+	}, addImagePullSecrets([]corev1.LocalObjectReference{{Name: "contrast-registry"}}, []string{"contrast-registry", "ghcr"}, "/spec/imagePullSecrets"))
+
+	assert.Empty(t, addImagePullSecrets(nil, nil, "/spec/imagePullSecrets"))
+}
+
+func TestMutateImagePullSecrets(t *testing.T) {
+	podYaml := `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: webgoat-pod
+  annotations:
+    contrast-agent-injector/language: java
+    contrast-agent-injector/version: 3.8.7.21531
+    contrast-agent-injector/enabled: "true"
+spec:
+  imagePullSecrets:
+  - name: webgoat-registry
+  containers:
+  - name: webgoat
+    image: webgoat/webgoat-8.0
+`
+	podJSON, err := yaml.YAMLToJSON([]byte(podYaml))
+	assert.NoError(t, err)
+
+	client := fake.NewSimpleClientset(pullSecret("contrast", nil, `{"auths":{}}`))
+	mutateConfig := &MutateConfig{
+		SecretName:       "test",
+		ImagePullSecrets: []string{"contrast-registry", "webgoat-registry"},
+		PullSecretCopier: NewPullSecretCopier(client, "contrast"),
+	}
+
+	dryRun := true
+	request := &admission.AdmissionRequest{
+		Resource:  podResource,
+		Namespace: "webgoat",
+		Object:    runtime.RawExtension{Raw: podJSON},
+		DryRun:    &dryRun,
+	}
+	patches, _, err := mutateConfig.mutate(request)
+	assert.NoError(t, err)
+	pod, err := applyPatches(podJSON, patches)
+	assert.NoError(t, err)
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "webgoat-registry"}, {Name: "contrast-registry"}}, pod.Spec.ImagePullSecrets)
+	// Dry runs don't copy the secret
+	_, err = client.CoreV1().Secrets("webgoat").Get(context.Background(), "contrast-registry", metav1.GetOptions{})
+	assert.Error(t, err)
+
+	dryRun = false
+	_, _, err = mutateConfig.mutate(request)
+	assert.NoError(t, err)
+	_, err = client.CoreV1().Secrets("webgoat").Get(context.Background(), "contrast-registry", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	// The agent isn't injected when the secret the init container needs can't be copied
+	mutateConfig.ImagePullSecrets = []string{"missing"}
+	_, _, err = mutateConfig.mutate(request)
+	assert.EqualError(t, err, `Skipping mutation: could not get image pull secret contrast/missing: secrets "missing" not found`)
+}
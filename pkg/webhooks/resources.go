@@ -0,0 +1,129 @@
+package webhooks
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// The init container resource annotations override the requests and limits configured for the injector
+	injectorCPURequestAnnotation    = `contrast-agent-injector/init-cpu-request`
+	injectorCPULimitAnnotation      = `contrast-agent-injector/init-cpu-limit`
+	injectorMemoryRequestAnnotation = `contrast-agent-injector/init-memory-request`
+	injectorMemoryLimitAnnotation   = `contrast-agent-injector/init-memory-limit`
+)
+
+// DefaultInitContainerUser is the user and group init containers run as when the Pod doesn't set them,
+// the nonroot user of the injector image
+const DefaultInitContainerUser int64 = 65532
+
+// DefaultInitContainerResources returns the requests and limits of init containers when the injector doesn't
+// configure them, enough for npm, pip and gem to install the agent
+func DefaultInitContainerResources() corev1.ResourceRequirements {
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("100m"),
+			corev1.ResourceMemory: resource.MustParse("128Mi"),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("512Mi"),
+		},
+	}
+}
+
+// initContainerResources returns the requests and limits for init containers, the resource annotations
+// take precedence over the defaults configured for the injector
+func initContainerResources(defaults corev1.ResourceRequirements, annotations map[string]string) (corev1.ResourceRequirements, error) {
+	resources := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{},
+		Limits:   corev1.ResourceList{},
+	}
+	for name, quantity := range defaults.Requests {
+		resources.Requests[name] = quantity
+	}
+	for name, quantity := range defaults.Limits {
+		resources.Limits[name] = quantity
+	}
+
+	overrides := []struct {
+		annotation string
+		list       corev1.ResourceList
+		name       corev1.ResourceName
+		request    bool
+	}{
+		{injectorCPURequestAnnotation, resources.Requests, corev1.ResourceCPU, true},
+		{injectorCPULimitAnnotation, resources.Limits, corev1.ResourceCPU, false},
+		{injectorMemoryRequestAnnotation, resources.Requests, corev1.ResourceMemory, true},
+		{injectorMemoryLimitAnnotation, resources.Limits, corev1.ResourceMemory, false},
+	}
+	annotatedRequests := map[corev1.ResourceName]bool{}
+	for _, override := range overrides {
+		value, ok := annotations[override.annotation]
+		if !ok {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return corev1.ResourceRequirements{}, fmt.Errorf("%v is not a valid quantity: %v", override.annotation, err)
+		}
+		override.list[override.name] = quantity
+		if override.request {
+			annotatedRequests[override.name] = true
+		}
+	}
+
+	// A request above the limit would be rejected by the API server. A default request is lowered to a lower
+	// limit, only an annotated request above the limit is an error.
+	for name, request := range resources.Requests {
+		limit, ok := resources.Limits[name]
+		if !ok || request.Cmp(limit) <= 0 {
+			continue
+		}
+		if annotatedRequests[name] {
+			return corev1.ResourceRequirements{}, fmt.Errorf("init container %v request %v exceeds the limit %v", name, request.String(), limit.String())
+		}
+		resources.Requests[name] = limit
+	}
+
+	if len(resources.Requests) == 0 {
+		resources.Requests = nil
+	}
+	if len(resources.Limits) == 0 {
+		resources.Limits = nil
+	}
+	return resources, nil
+}
+
+// initContainerSecurityContext returns a security context for init containers that passes the restricted Pod Security
+// Standard. The init containers run as the user and group of the Pod when it sets a non root user, otherwise as
+// defaultUser.
+func initContainerSecurityContext(podSecurityContext *corev1.PodSecurityContext, defaultUser int64) *corev1.SecurityContext {
+	runAsUser := defaultUser
+	runAsGroup := defaultUser
+	if podSecurityContext != nil && podSecurityContext.RunAsUser != nil && *podSecurityContext.RunAsUser != 0 {
+		runAsUser = *podSecurityContext.RunAsUser
+		if podSecurityContext.RunAsGroup != nil {
+			runAsGroup = *podSecurityContext.RunAsGroup
+		}
+	}
+
+	runAsNonRoot := true
+	readOnlyRootFilesystem := true
+	allowPrivilegeEscalation := false
+	return &corev1.SecurityContext{
+		RunAsUser:                &runAsUser,
+		RunAsGroup:               &runAsGroup,
+		RunAsNonRoot:             &runAsNonRoot,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
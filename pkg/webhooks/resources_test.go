@@ -0,0 +1,92 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestInitContainerResources(t *testing.T) {
+	resources, err := initContainerResources(DefaultInitContainerResources(), map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultInitContainerResources(), resources)
+
+	resources, err = initContainerResources(DefaultInitContainerResources(), map[string]string{
+		injectorCPURequestAnnotation:  "250m",
+		injectorMemoryLimitAnnotation: "1Gi",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "250m", resources.Requests.Cpu().String())
+	assert.Equal(t, "128Mi", resources.Requests.Memory().String())
+	assert.Equal(t, "1", resources.Limits.Cpu().String())
+	assert.Equal(t, "1Gi", resources.Limits.Memory().String())
+
+	// An injector without defaults only sets the annotated resources
+	resources, err = initContainerResources(corev1.ResourceRequirements{}, map[string]string{
+		injectorMemoryRequestAnnotation: "64Mi",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")},
+	}, resources)
+
+	_, err = initContainerResources(DefaultInitContainerResources(), map[string]string{
+		injectorCPULimitAnnotation: "lots",
+	})
+	assert.EqualError(t, err, "contrast-agent-injector/init-cpu-limit is not a valid quantity: quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'")
+
+	_, err = initContainerResources(DefaultInitContainerResources(), map[string]string{
+		injectorMemoryRequestAnnotation: "1Gi",
+	})
+	assert.EqualError(t, err, "init container memory request 1Gi exceeds the limit 512Mi")
+
+	// A limit below the default request lowers the request
+	resources, err = initContainerResources(DefaultInitContainerResources(), map[string]string{
+		injectorCPULimitAnnotation:    "50m",
+		injectorMemoryLimitAnnotation: "64Mi",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "50m", resources.Requests.Cpu().String())
+	assert.Equal(t, "64Mi", resources.Requests.Memory().String())
+	assert.Equal(t, "50m", resources.Limits.Cpu().String())
+	assert.Equal(t, "64Mi", resources.Limits.Memory().String())
+
+	_, err = initContainerResources(DefaultInitContainerResources(), map[string]string{
+		injectorCPURequestAnnotation: "100m",
+		injectorCPULimitAnnotation:   "50m",
+	})
+	assert.EqualError(t, err, "init container cpu request 100m exceeds the limit 50m")
+}
+
+func TestInitContainerSecurityContext(t *testing.T) {
+	user := int64(1000)
+	group := int64(2000)
+	root := int64(0)
+
+	tests := []struct {
+		name               string
+		podSecurityContext *corev1.PodSecurityContext
+		user               int64
+		group              int64
+	}{
+		{name: "no pod security context", user: DefaultInitContainerUser, group: DefaultInitContainerUser},
+		{name: "pod user and group", podSecurityContext: &corev1.PodSecurityContext{RunAsUser: &user, RunAsGroup: &group}, user: user, group: group},
+		{name: "pod user", podSecurityContext: &corev1.PodSecurityContext{RunAsUser: &user}, user: user, group: DefaultInitContainerUser},
+		{name: "pod root user", podSecurityContext: &corev1.PodSecurityContext{RunAsUser: &root, RunAsGroup: &group}, user: DefaultInitContainerUser, group: DefaultInitContainerUser},
+		{name: "pod group", podSecurityContext: &corev1.PodSecurityContext{RunAsGroup: &group}, user: DefaultInitContainerUser, group: DefaultInitContainerUser},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			securityContext := initContainerSecurityContext(test.podSecurityContext, DefaultInitContainerUser)
+			assert.Equal(t, test.user, *securityContext.RunAsUser)
+			assert.Equal(t, test.group, *securityContext.RunAsGroup)
+			assert.True(t, *securityContext.RunAsNonRoot)
+			assert.True(t, *securityContext.ReadOnlyRootFilesystem)
+			assert.False(t, *securityContext.AllowPrivilegeEscalation)
+			assert.Equal(t, []corev1.Capability{"ALL"}, securityContext.Capabilities.Drop)
+			assert.Equal(t, corev1.SeccompProfileTypeRuntimeDefault, securityContext.SeccompProfile.Type)
+		})
+	}
+}
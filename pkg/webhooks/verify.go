@@ -0,0 +1,262 @@
+package webhooks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// VerificationPolicyFail fails the init container when the downloaded agent doesn't match its checksum
+	VerificationPolicyFail = `fail`
+	// VerificationPolicyUninstrumented removes an agent that doesn't match its checksum and starts the application without it
+	VerificationPolicyUninstrumented = `uninstrumented`
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ArtifactVerification pins the SHA-256 of agent versions, which the init container verifies the downloaded
+// agent against. Versions without a pinned checksum are verified against the checksum of the artifact whose
+// detached signature was verified by the injector, when a signature is configured.
+type ArtifactVerification struct {
+	Policy    string             `json:"policy,omitempty"`
+	Checksums map[string]string  `json:"checksums,omitempty"`
+	Signature *ArtifactSignature `json:"signature,omitempty"`
+}
+
+// ArtifactSignature is an ASCII armored detached signature of the agent artifact, such as the .asc files published
+// to Maven Central. The URL is a template with the same data as the artifact URL, plus {{.ArtifactURL}}.
+type ArtifactSignature struct {
+	URL       string `json:"url"`
+	PublicKey string `json:"publicKey"`
+}
+
+func (verification ArtifactVerification) validate() error {
+	switch verification.Policy {
+	case "", VerificationPolicyFail, VerificationPolicyUninstrumented:
+	default:
+		return fmt.Errorf("verification policy must be %v or %v", VerificationPolicyFail, VerificationPolicyUninstrumented)
+	}
+	for version, checksum := range verification.Checksums {
+		if !sha256Pattern.MatchString(checksum) {
+			return fmt.Errorf("checksum for version %v is not a lower case hex encoded SHA-256", version)
+		}
+	}
+	if verification.Signature != nil {
+		if _, err := openpgp.ReadArmoredKeyRing(strings.NewReader(verification.Signature.PublicKey)); err != nil {
+			return fmt.Errorf("signature public key is invalid: %v", err)
+		}
+		if _, err := renderTemplate(verification.Signature.URL, agentTemplateData{Version: "1.0.0"}, templateFuncs(nil, nil)); err != nil {
+			return fmt.Errorf("signature url: %v", err)
+		}
+	}
+	return nil
+}
+
+func (verification ArtifactVerification) policy() string {
+	if len(verification.Policy) == 0 {
+		return VerificationPolicyFail
+	}
+	return verification.Policy
+}
+
+// ArtifactVerifier resolves the checksum the init container verifies a downloaded agent against. Signatures are
+// verified in the background, once per artifact URL, and admissions only wait for them up to a timeout so a slow
+// repository doesn't time out the webhook. Only the checksums of URLs that pin the version are cached.
+type ArtifactVerifier struct {
+	client *http.Client
+	// timeout is how long an admission waits for the signature of an artifact to be verified
+	timeout time.Duration
+	// retryAfter is how long a failed verification is reported before the artifact is downloaded again
+	retryAfter time.Duration
+	mutex      sync.Mutex
+	checksums  map[string]*signatureVerification
+}
+
+// signatureVerification is the verification of the signature of an artifact, done is closed once it finished
+type signatureVerification struct {
+	done     chan struct{}
+	checksum string
+	err      error
+	finished time.Time
+}
+
+// DefaultVerificationTimeout is how long an admission waits for the signature of an artifact to be verified
+const DefaultVerificationTimeout = 5 * time.Second
+
+// NewArtifactVerifier returns an ArtifactVerifier downloading artifacts and signatures with client
+func NewArtifactVerifier(client *http.Client) *ArtifactVerifier {
+	return &ArtifactVerifier{
+		client:     client,
+		timeout:    DefaultVerificationTimeout,
+		retryAfter: time.Minute,
+		checksums:  map[string]*signatureVerification{},
+	}
+}
+
+var defaultArtifactVerifier = NewArtifactVerifier(&http.Client{Timeout: 20 * time.Second})
+
+// verificationEnvVars returns the env vars passing the expected checksum and the verification policy to the
+// init container, or nothing if the artifact isn't verified
+func (verifier *ArtifactVerifier) verificationEnvVars(artifact ArtifactDefinition, data agentTemplateData) ([]corev1.EnvVar, error) {
+	if artifact.Verification == nil {
+		return nil, nil
+	}
+	checksum, err := verifier.checksum(artifact, data, verifier.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(checksum) == 0 {
+		log.Warnf("No checksum pinned for %v version %v, the agent will not be verified", artifact.Artifact, data.Version)
+		return nil, nil
+	}
+	return []corev1.EnvVar{
+		{
+			Name:  "CONTRAST_AGENT_SHA256",
+			Value: checksum,
+		},
+		{
+			Name:  "CONTRAST_VERIFICATION_POLICY",
+			Value: artifact.Verification.policy(),
+		},
+	}, nil
+}
+
+// checksum returns the pinned checksum of the version, or the checksum of the artifact whose signature was verified.
+// It waits up to timeout for the signature to be verified, or until it is verified when timeout isn't positive.
+// Artifact URLs that don't pin the version, such as the latest .NET Core agent, change between releases and their
+// signature isn't verified.
+func (verifier *ArtifactVerifier) checksum(artifact ArtifactDefinition, data agentTemplateData, timeout time.Duration) (string, error) {
+	verification := artifact.Verification
+	if checksum, ok := verification.Checksums[data.Version]; ok {
+		return checksum, nil
+	}
+	if verification.Signature == nil {
+		return "", nil
+	}
+
+	artifactURL, err := artifact.render(data)
+	if err != nil {
+		return "", err
+	}
+	if !pinsVersion(artifactURL, data.Version) {
+		log.Warnf("The url of %v version %v doesn't pin the version, its signature can't be verified", artifact.Artifact, data.Version)
+		return "", nil
+	}
+	data.Group = artifact.Group
+	data.Artifact = artifact.Artifact
+	data.ArtifactURL = artifactURL
+	signatureURL, err := renderTemplate(verification.Signature.URL, data, templateFuncs(nil, nil))
+	if err != nil {
+		return "", fmt.Errorf("signature url: %v", err)
+	}
+
+	result := verifier.verify(artifact.Artifact, data.Version, artifactURL, signatureURL, verification.Signature.PublicKey)
+	if timeout > 0 {
+		select {
+		case <-result.done:
+		case <-time.After(timeout):
+			return "", fmt.Errorf("the signature of %v version %v is still being verified, retry in a moment", artifact.Artifact, data.Version)
+		}
+	} else {
+		<-result.done
+	}
+	if result.err != nil {
+		return "", fmt.Errorf("could not verify the signature of %v version %v: %v", artifact.Artifact, data.Version, result.err)
+	}
+	return result.checksum, nil
+}
+
+// verify returns the verification of the signature of artifactURL, starting it in the background unless it is
+// already running, succeeded or recently failed
+func (verifier *ArtifactVerifier) verify(name, version, artifactURL, signatureURL, publicKey string) *signatureVerification {
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+	if result, ok := verifier.checksums[artifactURL]; ok {
+		select {
+		case <-result.done:
+			if result.err == nil || time.Since(result.finished) < verifier.retryAfter {
+				return result
+			}
+		default:
+			return result
+		}
+	}
+
+	result := &signatureVerification{done: make(chan struct{})}
+	verifier.checksums[artifactURL] = result
+	go func() {
+		result.checksum, result.err = verifier.verifySignature(artifactURL, signatureURL, publicKey)
+		result.finished = time.Now()
+		if result.err == nil {
+			log.Infof("Verified the signature of %v version %v", name, version)
+		} else {
+			log.WithError(result.err).Warnf("Could not verify the signature of %v version %v", name, version)
+		}
+		close(result.done)
+	}()
+	return result
+}
+
+// pinsVersion returns whether artifactURL only ever points at the given version of the artifact
+func pinsVersion(artifactURL, version string) bool {
+	if isVersionRange(version) {
+		return false
+	}
+	return strings.Contains(strings.ToLower(artifactURL), strings.ToLower(version))
+}
+
+// verifySignature downloads the artifact and its detached signature, returning the SHA-256 of the artifact
+// if the signature was made by publicKey
+func (verifier *ArtifactVerifier) verifySignature(artifactURL, signatureURL, publicKey string) (string, error) {
+	keyRing, err := openpgp.ReadArmoredKeyRing(strings.NewReader(publicKey))
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := verifier.get(signatureURL)
+	if err != nil {
+		return "", err
+	}
+	defer signature.Close()
+	signatureBytes, err := ioutil.ReadAll(signature)
+	if err != nil {
+		return "", err
+	}
+
+	artifact, err := verifier.get(artifactURL)
+	if err != nil {
+		return "", err
+	}
+	defer artifact.Close()
+
+	hash := sha256.New()
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyRing, io.TeeReader(artifact, hash), strings.NewReader(string(signatureBytes))); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (verifier *ArtifactVerifier) get(url string) (io.ReadCloser, error) {
+	response, err := verifier.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("unexpected status downloading %v: %v", url, response.Status)
+	}
+	return response.Body, nil
+}
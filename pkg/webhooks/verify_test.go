@@ -0,0 +1,188 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestVerificationEnvVarsPinnedChecksum(t *testing.T) {
+	checksum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	artifact := ArtifactDefinition{
+		Artifact: "contrast-agent",
+		URL:      "https://repo.example.com/{{ .Artifact }}-{{ .Version }}.jar",
+		Verification: &ArtifactVerification{
+			Policy:    VerificationPolicyUninstrumented,
+			Checksums: map[string]string{"3.8.7.21531": checksum},
+		},
+	}
+
+	envVars, err := NewArtifactVerifier(http.DefaultClient).verificationEnvVars(artifact, agentTemplateData{Version: "3.8.7.21531"})
+	assert.NoError(t, err)
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "CONTRAST_AGENT_SHA256", Value: checksum},
+		{Name: "CONTRAST_VERIFICATION_POLICY", Value: VerificationPolicyUninstrumented},
+	}, envVars)
+
+	// Versions without a pinned checksum and no signature aren't verified
+	envVars, err = NewArtifactVerifier(http.DefaultClient).verificationEnvVars(artifact, agentTemplateData{Version: "3.8.8.21600"})
+	assert.NoError(t, err)
+	assert.Empty(t, envVars)
+}
+
+func TestVerificationEnvVarsSignature(t *testing.T) {
+	entity, err := openpgp.NewEntity("Contrast Test", "", "test@example.com", nil)
+	assert.NoError(t, err)
+
+	var publicKey bytes.Buffer
+	armorWriter, err := armor.Encode(&publicKey, openpgp.PublicKeyType, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, entity.Serialize(armorWriter))
+	assert.NoError(t, armorWriter.Close())
+
+	agent := []byte("contrast agent jar")
+	var signature bytes.Buffer
+	assert.NoError(t, openpgp.ArmoredDetachSign(&signature, entity, bytes.NewReader(agent), nil))
+
+	requests := 0
+	repository := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requests++
+		switch request.URL.Path {
+		case "/contrast-agent-3.8.7.21531.jar", "/contrast-agent-3.8.8.21600.jar":
+			_, _ = response.Write(agent)
+		case "/contrast-agent-3.8.7.21531.jar.asc":
+			_, _ = response.Write(signature.Bytes())
+		case "/contrast-agent-3.8.8.21600.jar.asc":
+			_, _ = response.Write([]byte("not a signature"))
+		default:
+			http.NotFound(response, request)
+		}
+	}))
+	defer repository.Close()
+
+	artifact := ArtifactDefinition{
+		Artifact: "contrast-agent",
+		URL:      repository.URL + "/{{ .Artifact }}-{{ .Version }}.jar",
+		Verification: &ArtifactVerification{
+			Signature: &ArtifactSignature{
+				URL:       "{{ .ArtifactURL }}.asc",
+				PublicKey: publicKey.String(),
+			},
+		},
+	}
+	assert.NoError(t, artifact.validate())
+
+	verifier := NewArtifactVerifier(repository.Client())
+	envVars, err := verifier.verificationEnvVars(artifact, agentTemplateData{Version: "3.8.7.21531"})
+	assert.NoError(t, err)
+
+	expected := sha256.Sum256(agent)
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "CONTRAST_AGENT_SHA256", Value: hex.EncodeToString(expected[:])},
+		{Name: "CONTRAST_VERIFICATION_POLICY", Value: VerificationPolicyFail},
+	}, envVars)
+	assert.Equal(t, 2, requests)
+
+	// The checksum of a verified artifact is cached
+	_, err = verifier.verificationEnvVars(artifact, agentTemplateData{Version: "3.8.7.21531"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	_, err = verifier.verificationEnvVars(artifact, agentTemplateData{Version: "3.8.8.21600"})
+	assert.Error(t, err)
+}
+
+func TestVerificationEnvVarsSlowRepository(t *testing.T) {
+	entity, err := openpgp.NewEntity("Contrast Test", "", "test@example.com", nil)
+	assert.NoError(t, err)
+	var publicKey bytes.Buffer
+	armorWriter, err := armor.Encode(&publicKey, openpgp.PublicKeyType, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, entity.Serialize(armorWriter))
+	assert.NoError(t, armorWriter.Close())
+	agent := []byte("contrast agent nupkg")
+	var signature bytes.Buffer
+	assert.NoError(t, openpgp.ArmoredDetachSign(&signature, entity, bytes.NewReader(agent), nil))
+
+	release := make(chan struct{})
+	var requests int32
+	repository := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if strings.HasPrefix(request.URL.Path, "/slow/") {
+			<-release
+		}
+		if strings.HasSuffix(request.URL.Path, ".asc") {
+			_, _ = response.Write(signature.Bytes())
+			return
+		}
+		_, _ = response.Write(agent)
+	}))
+	defer repository.Close()
+	defer close(release)
+
+	artifact := func(url string) ArtifactDefinition {
+		return ArtifactDefinition{
+			Artifact: "Contrast.SensorsNetCore",
+			URL:      repository.URL + url,
+			Verification: &ArtifactVerification{
+				Signature: &ArtifactSignature{URL: "{{ .ArtifactURL }}.asc", PublicKey: publicKey.String()},
+			},
+		}
+	}
+	verifier := NewArtifactVerifier(repository.Client())
+	verifier.timeout = 50 * time.Millisecond
+
+	// Admissions don't wait for a slow repository, and don't block the verification of other artifacts
+	_, err = verifier.verificationEnvVars(artifact("/slow/{{ .Artifact }}/{{ .Version }}"), agentTemplateData{Version: "2.1.12"})
+	assert.EqualError(t, err, "the signature of Contrast.SensorsNetCore version 2.1.12 is still being verified, retry in a moment")
+	envVars, err := verifier.verificationEnvVars(artifact("/fast/{{ .Artifact }}/{{ .Version }}"), agentTemplateData{Version: "2.1.12"})
+	assert.NoError(t, err)
+	assert.Len(t, envVars, 2)
+
+	// The signature of a url that doesn't pin the version isn't verified, the url points at the next release later on
+	requestsBefore := atomic.LoadInt32(&requests)
+	envVars, err = verifier.verificationEnvVars(artifact("/fast/{{ .Artifact }}"), agentTemplateData{Version: "latest"})
+	assert.NoError(t, err)
+	assert.Empty(t, envVars)
+	envVars, err = verifier.verificationEnvVars(artifact("/fast/{{ .Artifact }}"), agentTemplateData{Version: "2.1.12"})
+	assert.NoError(t, err)
+	assert.Empty(t, envVars)
+	assert.Equal(t, requestsBefore, atomic.LoadInt32(&requests))
+}
+
+func TestArtifactVerificationValidate(t *testing.T) {
+	tt := []struct {
+		name         string
+		verification ArtifactVerification
+	}{
+		{
+			name:         "unknown policy",
+			verification: ArtifactVerification{Policy: "ignore"},
+		},
+		{
+			name:         "invalid checksum",
+			verification: ArtifactVerification{Checksums: map[string]string{"3.8.7.21531": "md5:abc"}},
+		},
+		{
+			name:         "invalid public key",
+			verification: ArtifactVerification{Signature: &ArtifactSignature{URL: "{{ .ArtifactURL }}.asc", PublicKey: "not a key"}},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Error(t, tc.verification.validate())
+		})
+	}
+}
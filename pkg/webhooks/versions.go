@@ -0,0 +1,257 @@
+package webhooks
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const latestVersion = `latest`
+
+// maxVersionLength is the longest version accepted from annotations and artifact metadata
+const maxVersionLength = 64
+
+// versionPattern is the grammar of agent versions: latest, a range such as x, 3.x or 3.8.*, or a dotted numeric
+// version with an optional qualifier such as 3.8.7.21531, 4.0.0-beta.1 or 5.0.0rc1
+var versionPattern = regexp.MustCompile(`^(?i:latest)$|^[x*]$|^[0-9]+(\.[0-9]+)*(\.[x*]|[-+]?[0-9A-Za-z]+([.+-][0-9A-Za-z]+)*)?$`)
+
+// validateVersion rejects versions that don't match the version grammar, so a version can never inject shell
+// commands, URL components or paths into the init container
+func validateVersion(version string) error {
+	if len(version) > maxVersionLength || !versionPattern.MatchString(version) {
+		return fmt.Errorf("%q is not a valid version, expected a version such as 3.8.7.21531, a range such as 3.x or latest", version)
+	}
+	return nil
+}
+
+// mavenMetadata is the subset of maven-metadata.xml used to resolve versions
+type mavenMetadata struct {
+	Versioning struct {
+		Latest   string   `xml:"latest"`
+		Release  string   `xml:"release"`
+		Versions []string `xml:"versions>version"`
+	} `xml:"versioning"`
+}
+
+type cachedVersions struct {
+	metadata  mavenMetadata
+	fetchedAt time.Time
+}
+
+// metadataFetch is a running fetch of the metadata at a URL, shared by every admission waiting for it
+type metadataFetch struct {
+	done     chan struct{}
+	metadata mavenMetadata
+	err      error
+}
+
+// VersionResolver resolves latest and version ranges such as 3.x to a concrete agent version using the
+// maven-metadata.xml of the artifact, so every replica of a workload runs the same agent version.
+// Metadata is cached for ttl, and stale metadata is used if the repository can't be reached. Metadata is fetched
+// once per URL at a time, and a slow repository doesn't hold up resolving versions from other URLs.
+type VersionResolver struct {
+	client  *http.Client
+	ttl     time.Duration
+	now     func() time.Time
+	mutex   sync.Mutex
+	cache   map[string]cachedVersions
+	fetches map[string]*metadataFetch
+}
+
+// NewVersionResolver returns a VersionResolver fetching metadata with client and caching it for ttl
+func NewVersionResolver(client *http.Client, ttl time.Duration) *VersionResolver {
+	return &VersionResolver{
+		client:  client,
+		ttl:     ttl,
+		now:     time.Now,
+		cache:   map[string]cachedVersions{},
+		fetches: map[string]*metadataFetch{},
+	}
+}
+
+var defaultVersionResolver = NewVersionResolver(&http.Client{Timeout: 10 * time.Second}, 10*time.Minute)
+
+// isVersionRange returns true for latest and versions ending in a wildcard segment, e.g. 3.x or 3.8.*
+func isVersionRange(version string) bool {
+	if strings.EqualFold(version, latestVersion) {
+		return true
+	}
+	return version == "x" || version == "*" || strings.HasSuffix(version, ".x") || strings.HasSuffix(version, ".*")
+}
+
+// resolve returns the concrete version for version. Concrete versions, and latest for agents without artifact
+// metadata, are returned unchanged. Ranges can only be resolved for agents with artifact metadata, the package
+// managers and agent images of the other agents don't understand them.
+func (resolver *VersionResolver) resolve(definition AgentDefinition, version string) (string, error) {
+	if !isVersionRange(version) {
+		return version, nil
+	}
+	if definition.Artifact == nil || len(definition.Artifact.MetadataURL) == 0 {
+		if strings.EqualFold(version, latestVersion) {
+			return version, nil
+		}
+		return "", fmt.Errorf("%v is invalid: version ranges such as %v can't be resolved for the %v agent, use a version or latest",
+			injectorVersionAnnotation, version, definition.Language)
+	}
+
+	artifact := *definition.Artifact
+	metadataURL, err := artifact.renderMetadataURL()
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err := resolver.metadata(metadataURL)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %v version %v: %v", artifact.Artifact, version, err)
+	}
+
+	resolved := selectVersion(metadata, version)
+	if len(resolved) == 0 {
+		return "", fmt.Errorf("no version of %v matches %v", artifact.Artifact, version)
+	}
+	log.Infof("Resolved %v version %v to %v", artifact.Artifact, version, resolved)
+
+	return resolved, nil
+}
+
+func (resolver *VersionResolver) metadata(metadataURL string) (mavenMetadata, error) {
+	resolver.mutex.Lock()
+	cached, ok := resolver.cache[metadataURL]
+	if ok && resolver.now().Sub(cached.fetchedAt) < resolver.ttl {
+		resolver.mutex.Unlock()
+		return cached.metadata, nil
+	}
+	fetch, fetching := resolver.fetches[metadataURL]
+	if !fetching {
+		fetch = &metadataFetch{done: make(chan struct{})}
+		resolver.fetches[metadataURL] = fetch
+	}
+	resolver.mutex.Unlock()
+
+	// The first admission fetches the metadata without holding the lock, the others wait for its result
+	if fetching {
+		<-fetch.done
+	} else {
+		fetch.metadata, fetch.err = resolver.fetch(metadataURL)
+		resolver.mutex.Lock()
+		if fetch.err == nil {
+			resolver.cache[metadataURL] = cachedVersions{
+				metadata:  fetch.metadata,
+				fetchedAt: resolver.now(),
+			}
+		}
+		delete(resolver.fetches, metadataURL)
+		resolver.mutex.Unlock()
+		close(fetch.done)
+	}
+
+	if fetch.err != nil {
+		if ok {
+			log.Warnf("Using cached metadata from %v: %v", metadataURL, fetch.err)
+			return cached.metadata, nil
+		}
+		return mavenMetadata{}, fetch.err
+	}
+	return fetch.metadata, nil
+}
+
+func (resolver *VersionResolver) fetch(metadataURL string) (mavenMetadata, error) {
+	var metadata mavenMetadata
+	response, err := resolver.client.Get(metadataURL)
+	if err != nil {
+		return metadata, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return metadata, fmt.Errorf("unexpected status fetching %v: %v", metadataURL, response.Status)
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&metadata); err != nil {
+		return metadata, fmt.Errorf("could not parse %v: %v", metadataURL, err)
+	}
+	return metadata, nil
+}
+
+// selectVersion returns the highest release version matching version, latest prefers the release
+// version from the metadata. Snapshots and pre-releases are never selected.
+func selectVersion(metadata mavenMetadata, version string) string {
+	if strings.EqualFold(version, latestVersion) && len(metadata.Versioning.Release) != 0 {
+		return metadata.Versioning.Release
+	}
+
+	prefix := strings.TrimRight(version, "x*")
+	if strings.EqualFold(version, latestVersion) {
+		prefix = ""
+	}
+
+	var selected string
+	for _, candidate := range metadata.Versioning.Versions {
+		if isPreRelease(candidate) || !strings.HasPrefix(candidate, prefix) {
+			continue
+		}
+		if len(selected) == 0 || compareVersions(candidate, selected) > 0 {
+			selected = candidate
+		}
+	}
+	return selected
+}
+
+// isPreRelease returns true for versions with a qualifier, such as 4.0.0-beta.1, 5.0.0rc1 or 4.0.0-SNAPSHOT
+func isPreRelease(version string) bool {
+	release := strings.SplitN(version, "+", 2)[0]
+	return strings.ContainsAny(release, "-abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+}
+
+// compareVersions compares dot separated versions segment by segment, numerically where both segments are numbers.
+// A pre-release, such as 4.0.0-beta, sorts below its release.
+func compareVersions(a, b string) int {
+	aRelease, aQualifier := splitQualifier(a)
+	bRelease, bQualifier := splitQualifier(b)
+	if result := compareSegments(aRelease, bRelease); result != 0 {
+		return result
+	}
+	switch {
+	case aQualifier == bQualifier:
+		return 0
+	case len(aQualifier) == 0:
+		return 1
+	case len(bQualifier) == 0:
+		return -1
+	}
+	return compareSegments(aQualifier, bQualifier)
+}
+
+// splitQualifier splits a version into its release and its pre-release qualifier, e.g. 4.0.0 and beta.1
+func splitQualifier(version string) (string, string) {
+	parts := strings.SplitN(strings.SplitN(version, "+", 2)[0], "-", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// compareSegments compares dot separated segments, numerically where both segments are numbers
+func compareSegments(a, b string) int {
+	aSegments := strings.Split(a, ".")
+	bSegments := strings.Split(b, ".")
+	for i := 0; i < len(aSegments) && i < len(bSegments); i++ {
+		aNumber, aErr := strconv.Atoi(aSegments[i])
+		bNumber, bErr := strconv.Atoi(bSegments[i])
+		switch {
+		case aErr == nil && bErr == nil && aNumber != bNumber:
+			if aNumber < bNumber {
+				return -1
+			}
+			return 1
+		case (aErr != nil || bErr != nil) && aSegments[i] != bSegments[i]:
+			return strings.Compare(aSegments[i], bSegments[i])
+		}
+	}
+	return len(aSegments) - len(bSegments)
+}
